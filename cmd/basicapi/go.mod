@@ -7,13 +7,14 @@ require (
 	github.com/labiraus/go-utils/pkg/base v0.0.0-20250724213018-3e152debf928
 	github.com/labiraus/go-utils/pkg/kubernetesutil v0.0.0-20250724213018-3e152debf928
 	github.com/labiraus/go-utils/pkg/prometheusutil v0.0.0-20250724213018-3e152debf928
-	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/labiraus/go-utils/pkg/redisutil v0.0.0-20250724213018-3e152debf928
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/emicklei/go-restful/v3 v3.12.1 // indirect
 	github.com/go-logr/logr v1.4.3 // indirect
 	github.com/go-openapi/jsonpointer v0.21.0 // indirect
@@ -35,10 +36,12 @@ require (
 	github.com/prometheus/client_model v0.6.1 // indirect
 	github.com/prometheus/common v0.48.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/redis/go-redis/v9 v9.5.3 // indirect
 	github.com/rogpeppe/go-internal v1.13.1 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/oauth2 v0.30.0 // indirect
+	golang.org/x/sync v0.18.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/term v0.37.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
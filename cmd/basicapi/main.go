@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,8 +14,7 @@ import (
 	"github.com/labiraus/go-utils/pkg/base"
 	"github.com/labiraus/go-utils/pkg/kubernetesutil"
 	"github.com/labiraus/go-utils/pkg/prometheusutil"
-
-	"github.com/patrickmn/go-cache"
+	"github.com/labiraus/go-utils/pkg/redisutil"
 )
 
 const (
@@ -22,8 +22,8 @@ const (
 )
 
 var (
-	c          = cache.New(5*time.Minute, 10*time.Minute)
-	kubeAccess = false
+	secretCache *redisutil.Cache[string, string]
+	kubeAccess  = false
 )
 
 func main() {
@@ -40,11 +40,24 @@ func main() {
 		}
 	}()
 
+	secretCache, err = redisutil.NewCache(ctx, nil, redisutil.CacheConfig[string, string]{
+		Name:      "secret",
+		TTL:       5 * time.Minute,
+		LocalSize: 1,
+		Loader:    loadSecret,
+	})
+	if err != nil {
+		return
+	}
+
+	adminMux := http.NewServeMux()
+	prometheusutil.Start(adminMux)
+	adminDone := api.StartAdmin(ctx, adminMux, 9090)
+
 	mux := http.NewServeMux()
-	prometheusutil.Start(mux)
 	mux.HandleFunc("/hello", helloHandler)
 
-	done := api.Start(ctx, mux, 8080)
+	done := api.StartPublic(ctx, mux, 8080)
 
 	kubeAccess, err = kubernetesutil.Start()
 	if err != nil {
@@ -55,6 +68,7 @@ func main() {
 	}
 	close(base.Ready)
 	<-done
+	<-adminDone
 	slog.InfoContext(ctx, "finishing")
 }
 
@@ -95,20 +109,15 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 		request.UserID = 1
 	}
 
-	secretValue, ok := c.Get("secretValue")
-	if !ok {
-		slog.DebugContext(r.Context(), "reloading secret configValue")
-		if !kubeAccess {
-			secretValue = "no secret"
-		} else {
-			secretValue = base.GetEnv("SECRETVALUE", "no secret")
-		}
-		c.Set("secretValue", secretValue, cache.DefaultExpiration)
+	secretValue, err := secretCache.Get(r.Context(), "secretValue")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	response := UserResponse{
 		UserID:   request.UserID,
-		Username: secretValue.(string),
+		Username: secretValue,
 		Email:    "something@somewhere.com",
 	}
 
@@ -125,3 +134,11 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func loadSecret(ctx context.Context, key string) (string, error) {
+	slog.DebugContext(ctx, "reloading secret configValue")
+	if !kubeAccess {
+		return "no secret", nil
+	}
+	return base.GetEnv("SECRETVALUE", "no secret"), nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/labiraus/go-utils/pkg/redisutil"
+)
+
+// defaultReplay is how many messages new joiners get when they don't ask with ?last=
+const defaultReplay = 20
+
+// maxHistoryLine is the longest file history line that is replayed. It leaves room for the
+// JSON escaping of a maxMessageSize message; longer lines are skipped.
+const maxHistoryLine = 1024 * 1024
+
+// historyQueue is how many appends a room's history writer can fall behind by before
+// history is dropped
+const historyQueue = 100
+
+// historyTimeout bounds every append, so that a slow store loses history rather than
+// holding up the room's writer indefinitely
+const historyTimeout = 5 * time.Second
+
+// historyStore records what's said in each room so that new joiners can catch up
+type historyStore interface {
+	Append(ctx context.Context, room string, entry event) error
+	// Recent returns up to limit entries sent after since, oldest first
+	Recent(ctx context.Context, room string, limit int, since time.Time) ([]event, error)
+}
+
+// newHistory picks the store from HISTORY_STORE, which is memory, file or redis. History
+// has to survive restarts, so the default is redis when it's configured and file otherwise;
+// memory is only meant for development. client is nil when redis isn't configured.
+func newHistory(client *redisutil.Client) (historyStore, error) {
+	size, err := strconv.Atoi(base.GetEnv("HISTORY_SIZE", "100"))
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("invalid HISTORY_SIZE: %v", base.GetEnv("HISTORY_SIZE", ""))
+	}
+	defaultStore := "file"
+	if client != nil {
+		defaultStore = "redis"
+	}
+	switch store := base.GetEnv("HISTORY_STORE", defaultStore); store {
+	case "memory":
+		return newMemoryHistory(size), nil
+	case "file":
+		return newFileHistory(base.GetEnv("HISTORY_DIR", "history"), size)
+	case "redis":
+		if client == nil {
+			return nil, fmt.Errorf("HISTORY_STORE is redis but REDIS_HOST isn't set")
+		}
+		return newRedisHistory(client, size), nil
+	default:
+		return nil, fmt.Errorf("unknown HISTORY_STORE: %v", store)
+	}
+}
+
+// startHistoryWriter appends a room's events to store in order, off the room goroutine.
+// Appends already queued are still written after ctx is done, until the channel is closed.
+func startHistoryWriter(ctx context.Context, store historyStore, roomName string) chan<- event {
+	entries := make(chan event, historyQueue)
+	go func() {
+		for entry := range entries {
+			appendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), historyTimeout)
+			if err := store.Append(appendCtx, roomName, entry); err != nil {
+				slog.ErrorContext(ctx, "failed to record history", "roomName", roomName, "eventID", entry.ID, "error", err)
+			}
+			cancel()
+		}
+	}()
+	return entries
+}
+
+// replayRequest reads how much history a joiner wants from the ?last= and ?since= query
+// parameters, since being RFC 3339. Without last, joiners get defaultReplay messages or
+// everything since since, up to limit.
+func replayRequest(query url.Values, limit int) (int, time.Time, error) {
+	last := defaultReplay
+	if query.Has("since") {
+		last = limit
+	}
+	if value := query.Get("last"); value != "" {
+		var err error
+		last, err = strconv.Atoi(value)
+		if err != nil || last < 0 {
+			return 0, time.Time{}, fmt.Errorf("invalid last: %v", value)
+		}
+	}
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid since: %v", value)
+		}
+	}
+	return min(last, limit), since, nil
+}
+
+// recent keeps the last limit entries after since from entries, which are oldest first
+func recent(entries []event, limit int, since time.Time) []event {
+	start := len(entries)
+	for start > 0 && len(entries)-start < limit && entries[start-1].Time.After(since) {
+		start--
+	}
+	return entries[start:]
+}
+
+// memoryHistory keeps the last size entries of every room and loses them on restart
+type memoryHistory struct {
+	mux   sync.Mutex
+	size  int
+	rooms map[string][]event
+}
+
+func newMemoryHistory(size int) *memoryHistory {
+	return &memoryHistory{size: size, rooms: make(map[string][]event)}
+}
+
+func (h *memoryHistory) Append(ctx context.Context, room string, entry event) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	entries := append(h.rooms[room], entry)
+	h.rooms[room] = entries[max(0, len(entries)-h.size):]
+	return nil
+}
+
+func (h *memoryHistory) Recent(ctx context.Context, room string, limit int, since time.Time) ([]event, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return append([]event(nil), recent(h.rooms[room], limit, since)...), nil
+}
+
+// fileHistory appends every room to its own JSON lines file in dir and keeps the last size
+// entries of each room it has seen in memory, so joins never read the file. Files are
+// compacted down to size entries once they hold twice that.
+type fileHistory struct {
+	mux   sync.Mutex
+	dir   string
+	size  int
+	rooms map[string]*fileRoom
+}
+
+type fileRoom struct {
+	entries []event
+	// lines is how many lines the file holds, counting ones that couldn't be read
+	lines int
+}
+
+func newFileHistory(dir string, size int) (*fileHistory, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create history directory %v: %w", dir, err)
+	}
+	return &fileHistory{dir: dir, size: size, rooms: make(map[string]*fileRoom)}, nil
+}
+
+func (h *fileHistory) path(room string) string {
+	return filepath.Join(h.dir, url.PathEscape(room)+".jsonl")
+}
+
+func (h *fileHistory) Append(ctx context.Context, room string, entry event) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	cached, err := h.load(room)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path(room), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open history for room %v: %w", room, err)
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to append history for room %v: %w", room, err)
+	}
+
+	entries := append(cached.entries, entry)
+	cached.entries = entries[max(0, len(entries)-h.size):]
+	cached.lines++
+	if cached.lines >= 2*h.size {
+		return h.compact(room, cached)
+	}
+	return nil
+}
+
+func (h *fileHistory) Recent(ctx context.Context, room string, limit int, since time.Time) ([]event, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	cached, err := h.load(room)
+	if err != nil {
+		return nil, err
+	}
+	return append([]event(nil), recent(cached.entries, limit, since)...), nil
+}
+
+// load reads the tail of a room's file the first time the room is used
+func (h *fileHistory) load(room string) (*fileRoom, error) {
+	if cached, ok := h.rooms[room]; ok {
+		return cached, nil
+	}
+	cached := &fileRoom{}
+	file, err := os.Open(h.path(room))
+	if os.IsNotExist(err) {
+		h.rooms[room] = cached
+		return cached, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history for room %v: %w", room, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxHistoryLine)
+	scanner.Split(skipLongLines(maxHistoryLine))
+	for scanner.Scan() {
+		cached.lines++
+		var entry event
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a crash mid-write leaves a partial last line
+			continue
+		}
+		cached.entries = append(cached.entries, entry)
+		if len(cached.entries) > 2*h.size {
+			cached.entries = append(cached.entries[:0], cached.entries[len(cached.entries)-h.size:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history for room %v: %w", room, err)
+	}
+	cached.entries = cached.entries[max(0, len(cached.entries)-h.size):]
+	h.rooms[room] = cached
+	return cached, nil
+}
+
+// compact rewrites a room's file with only the entries kept in memory. The file is
+// replaced by a rename so that a crash leaves either the old or the new file.
+func (h *fileHistory) compact(room string, cached *fileRoom) error {
+	var data []byte
+	for _, entry := range cached.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	tmp := h.path(room) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to compact history for room %v: %w", room, err)
+	}
+	if err := os.Rename(tmp, h.path(room)); err != nil {
+		return fmt.Errorf("failed to compact history for room %v: %w", room, err)
+	}
+	cached.lines = len(cached.entries)
+	return nil
+}
+
+// skipLongLines splits like bufio.ScanLines but drops lines that don't fit in max bytes
+// rather than failing the scan, so that one oversized entry can't stop every replay
+func skipLongLines(max int) bufio.SplitFunc {
+	skipping := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				skipping = false
+				return i + 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && err == nil && len(data) >= max {
+			skipping = true
+			return len(data), nil, nil
+		}
+		return advance, token, err
+	}
+}
+
+// redisHistory keeps the last size entries of every room in a redis list, which is shared
+// by every replica
+type redisHistory struct {
+	client *redisutil.Client
+	size   int
+}
+
+func newRedisHistory(client *redisutil.Client, size int) *redisHistory {
+	return &redisHistory{client: client, size: size}
+}
+
+func historyKey(room string) string {
+	return "chat:history:" + room
+}
+
+func (h *redisHistory) Append(ctx context.Context, room string, entry event) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pipe := h.client.TxPipeline()
+	pipe.RPush(ctx, historyKey(room), data)
+	pipe.LTrim(ctx, historyKey(room), int64(-h.size), -1)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to append history for room %v: %w", room, err)
+	}
+	return nil
+}
+
+func (h *redisHistory) Recent(ctx context.Context, room string, limit int, since time.Time) ([]event, error) {
+	values, err := h.client.LRange(ctx, historyKey(room), int64(-limit), -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history for room %v: %w", room, err)
+	}
+	entries := make([]event, 0, len(values))
+	for _, value := range values {
+		var entry event
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return recent(entries, limit, since), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/labiraus/go-utils/pkg/redisutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHistory(t *testing.T, store historyStore) {
+	ctx := context.Background()
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	userID := uuid.New()
+	for i, text := range []string{"one", "two", "three", "four"} {
+		assert.NoError(t, store.Append(ctx, "/room", event{UserID: userID, Text: text, Time: start.Add(time.Duration(i) * time.Minute)}))
+	}
+	assert.NoError(t, store.Append(ctx, "/other", event{UserID: userID, Text: "elsewhere", Time: start}))
+
+	texts := func(entries []event) []string {
+		var texts []string
+		for _, entry := range entries {
+			texts = append(texts, entry.Text)
+		}
+		return texts
+	}
+
+	entries, err := store.Recent(ctx, "/room", 2, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"three", "four"}, texts(entries))
+	assert.Equal(t, userID, entries[0].UserID)
+
+	entries, err = store.Recent(ctx, "/room", 10, start.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"three", "four"}, texts(entries))
+
+	entries, err = store.Recent(ctx, "/room", 10, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "two", "three", "four"}, texts(entries))
+
+	entries, err = store.Recent(ctx, "/empty", 10, time.Time{})
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestMemoryHistory(t *testing.T) {
+	testHistory(t, newMemoryHistory(100))
+
+	store := newMemoryHistory(2)
+	for _, text := range []string{"one", "two", "three"} {
+		store.Append(context.Background(), "/room", event{Text: text, Time: time.Now()})
+	}
+	entries, err := store.Recent(context.Background(), "/room", 10, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "two", entries[0].Text)
+}
+
+func TestFileHistorySurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileHistory(dir, 100)
+	assert.NoError(t, err)
+	testHistory(t, store)
+
+	restarted, err := newFileHistory(dir, 100)
+	assert.NoError(t, err)
+	entries, err := restarted.Recent(context.Background(), "/room", 1, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "four", entries[0].Text)
+}
+
+func TestFileHistoryCompacts(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := newFileHistory(dir, 3)
+	assert.NoError(t, err)
+	for i := range 10 {
+		assert.NoError(t, store.Append(ctx, "/room", event{Text: fmt.Sprint(i), Time: time.Now()}))
+	}
+
+	// compacted back to 3 lines whenever it reaches 6, last after the ninth entry
+	data, err := os.ReadFile(store.path("/room"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), "\n"))
+
+	restarted, err := newFileHistory(dir, 3)
+	assert.NoError(t, err)
+	entries, err := restarted.Recent(ctx, "/room", 10, time.Time{})
+	assert.NoError(t, err)
+	var texts []string
+	for _, entry := range entries {
+		texts = append(texts, entry.Text)
+	}
+	assert.Equal(t, []string{"7", "8", "9"}, texts)
+}
+
+func TestFileHistorySkipsLinesTooLongToReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := newFileHistory(dir, 100)
+	assert.NoError(t, err)
+
+	// longer than bufio.Scanner's default 64KiB limit
+	long := strings.Repeat("<", maxMessageSize)
+	assert.NoError(t, store.Append(ctx, "/room", event{Text: long, Time: time.Now()}))
+	file, err := os.OpenFile(store.path("/room"), os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = file.WriteString(strings.Repeat("x", 2*maxHistoryLine) + "\n")
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	assert.NoError(t, store.Append(ctx, "/room", event{Text: "after", Time: time.Now()}))
+
+	restarted, err := newFileHistory(dir, 100)
+	assert.NoError(t, err)
+	entries, err := restarted.Recent(ctx, "/room", 10, time.Time{})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, long, entries[0].Text)
+		assert.Equal(t, "after", entries[1].Text)
+	}
+}
+
+func TestRedisHistory(t *testing.T) {
+	server := miniredis.RunT(t)
+	client, err := redisutil.New(context.Background(), map[string]redisutil.RedisConfig{
+		"redis": {Host: server.Host(), Port: server.Port()},
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	testHistory(t, newRedisHistory(client, 100))
+
+	store := newRedisHistory(client, 2)
+	store.Append(context.Background(), "/trimmed", event{Text: "one"})
+	store.Append(context.Background(), "/trimmed", event{Text: "two"})
+	store.Append(context.Background(), "/trimmed", event{Text: "three"})
+	values, err := client.LRange(context.Background(), historyKey("/trimmed"), 0, -1).Result()
+	assert.NoError(t, err)
+	assert.Len(t, values, 2)
+}
+
+func TestReplayRequest(t *testing.T) {
+	last, since, err := replayRequest(url.Values{}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultReplay, last)
+	assert.True(t, since.IsZero())
+
+	last, since, err = replayRequest(url.Values{"since": {"2025-01-01T00:00:00Z"}}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, last)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), since)
+
+	last, _, err = replayRequest(url.Values{"last": {"500"}}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, last)
+
+	_, _, err = replayRequest(url.Values{"last": {"-1"}}, 100)
+	assert.Error(t, err)
+	_, _, err = replayRequest(url.Values{"since": {"yesterday"}}, 100)
+	assert.Error(t, err)
+}
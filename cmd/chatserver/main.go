@@ -1,21 +1,27 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"sync"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/labiraus/go-utils/pkg/api"
 	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/labiraus/go-utils/pkg/redisutil"
 )
 
+// chatMessage is something a user sent to their room, either text or a typing indicator
 type chatMessage struct {
 	text   string
+	typing bool
 	userID uuid.UUID
 }
 
@@ -23,8 +29,17 @@ type registration struct {
 	add      bool
 	roomName string
 	userID   uuid.UUID
-	outbound chan<- string
-	inbound  chan<- chan<- chatMessage
+	name     string
+	outbound chan<- event
+	joined   chan<- joinedRoom
+}
+
+// joinedRoom is what a room hands a user once they're registered
+type joinedRoom struct {
+	inbound chan<- chatMessage
+	// said is what the room said most recently before the user joined, which the history
+	// store may not have caught up with yet
+	said []event
 }
 
 type chatRoom struct {
@@ -33,7 +48,23 @@ type chatRoom struct {
 	roomName      string
 }
 
-var registrationChan = make(chan registration, 100)
+// chatServer is what the controller, rooms and handlers share. Nothing is global so that
+// tests can run servers side by side.
+type chatServer struct {
+	registrations chan registration
+	// presence is only set when redis is configured, rooms are process-local otherwise
+	presence *redisutil.Presence
+	// history records every room's messages for replay to new joiners
+	history historyStore
+}
+
+func newChatServer(history historyStore, presence *redisutil.Presence) *chatServer {
+	return &chatServer{
+		registrations: make(chan registration, 100),
+		presence:      presence,
+		history:       history,
+	}
+}
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -54,57 +85,86 @@ func main() {
 			slog.ErrorContext(ctx, err.Error())
 		}
 	}()
+	var client *redisutil.Client
+	var presence *redisutil.Presence
+	if redisHost := base.GetEnv("REDIS_HOST", ""); redisHost != "" {
+		client, err = redisutil.New(ctx, map[string]redisutil.RedisConfig{
+			"redis": {Host: redisHost, Port: base.GetEnv("REDIS_PORT", "6379")},
+		})
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		presence = redisutil.NewPresence(client, 30*time.Second)
+	}
+	history, err := newHistory(client)
+	if err != nil {
+		return
+	}
+	server := newChatServer(history, presence)
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", websocketHandler)
-	done := roomController(ctx)
+	mux.HandleFunc("/", server.websocketHandler)
+	mux.HandleFunc("GET /presence/", server.presenceHandler)
+	done := server.roomController(ctx)
 	api.Start(ctx, mux, 8080)
 
 	<-done
 }
 
-func roomController(ctx context.Context) chan struct{} {
+func (s *chatServer) roomController(ctx context.Context) chan struct{} {
 	done := make(chan struct{})
-	roomRegistrations := map[string]chatRoom{}
 	slog.InfoContext(ctx, "starting controller")
 
-	// wg counts how many active rooms there are and allows all rooms to be shut down before
-	var wg sync.WaitGroup
 	go func() {
-		defer close(done)
-		<-ctx.Done()
-		wg.Wait()
-	}()
+		// rooms is only touched here, rooms report back on closed once they've shut down
+		rooms := map[string]chatRoom{}
+		closed := make(chan string)
+		shutdown := ctx.Done()
+		finished := false
+		for {
+			select {
+			case <-shutdown:
+				shutdown = nil
+			case roomName := <-closed:
+				delete(rooms, roomName)
+			case reg := <-s.registrations:
+				room, ok := rooms[reg.roomName]
+				if !ok {
+					room = s.createRoom(reg.roomName, ctx)
+					rooms[reg.roomName] = room
+					go func() {
+						<-room.done
+						closed <- room.roomName
+					}()
+				}
 
-	go func() {
-		for reg := range registrationChan {
-			room, ok := roomRegistrations[reg.roomName]
-			if !ok {
-				room = createRoom(reg.roomName, ctx)
-				go func(room chatRoom) {
-					defer wg.Done()
-					defer delete(roomRegistrations, room.roomName)
-					wg.Add(1)
-					<-room.done
-				}(room)
-				roomRegistrations[reg.roomName] = room
+				go func() {
+					// room registration is an unbuffered channel to prevent anyone from being added to a room whilst it's shutting down
+					// this means that registration needs to be asynchronous
+					select {
+					case room.registrations <- reg:
+					case <-room.done:
+						// deregistrations have nothing to do once the room is gone
+						if reg.add {
+							close(reg.joined)
+						}
+					}
+				}()
 			}
 
-			go func() {
-				// room registration is an unbuffered channel to prevent anyone from being added to a room whilst it's shutting down
-				// this means that registration needs to be asynchronous
-				select {
-				case room.registrations <- reg:
-				case <-room.done:
-					close(reg.inbound)
-				}
-			}()
+			// keep serving registrations after shutdown so that handlers never block on them
+			if shutdown == nil && len(rooms) == 0 && !finished {
+				close(done)
+				finished = true
+			}
 		}
 	}()
 
 	return done
 }
 
-func createRoom(roomName string, ctx context.Context) chatRoom {
+func (s *chatServer) createRoom(roomName string, ctx context.Context) chatRoom {
 	slog.InfoContext(ctx, "creating room", "roomName", roomName)
 	registrations := make(chan registration)
 	done := make(chan struct{})
@@ -112,7 +172,16 @@ func createRoom(roomName string, ctx context.Context) chatRoom {
 	go func() {
 		defer close(done)
 
-		users := map[uuid.UUID]chan<- string{}
+		room := &roomState{
+			server:   s,
+			ctx:      ctx,
+			roomName: roomName,
+			users:    map[uuid.UUID]chan<- event{},
+			names:    map[uuid.UUID]string{},
+			presence: map[uuid.UUID]*memberPresence{},
+			history:  startHistoryWriter(ctx, s.history, roomName),
+		}
+		defer close(room.history)
 		inbound := make(chan chatMessage, 1000)
 
 		// the ticker kills empty channels after 10 sec
@@ -121,42 +190,31 @@ func createRoom(roomName string, ctx context.Context) chatRoom {
 		for {
 			select {
 			case <-ctx.Done():
-				for _, user := range users {
+				for _, user := range room.users {
 					close(user)
 				}
 				return
 
 			case reg := <-registrations:
 				if reg.add {
-					users[reg.userID] = reg.outbound
-					reg.inbound <- inbound
+					room.users[reg.userID] = reg.outbound
+					room.names[reg.userID] = reg.name
+					reg.joined <- joinedRoom{inbound: inbound, said: slices.Clone(room.said)}
 					slog.InfoContext(ctx, "registering user", "userID", reg.userID, "roomName", reg.roomName)
+					room.presence[reg.userID] = joinPresence(ctx, s.presence, roomName, reg.userID, reg.name)
+					room.broadcast(newEvent(joinEvent, reg.userID, reg.name, reg.name+" joined"), uuid.Nil)
 				} else {
-					user, ok := users[reg.userID]
-					if ok {
-						close(user)
-					}
 					slog.InfoContext(ctx, "deregistering user", "userID", reg.userID, "roomName", reg.roomName)
-					delete(users, reg.userID)
+					room.leave(reg.userID)
 				}
 				ticker.Reset(10 * time.Second)
 
 			case message := <-inbound:
-				for userID, user := range users {
-					if userID != message.userID {
-						select {
-						case user <- message.text:
-						default:
-							slog.ErrorContext(ctx, "unable to send messages to user, cutting them off", "userID", userID)
-							close(user)
-							delete(users, userID)
-						}
-					}
-				}
+				room.handle(message)
 				ticker.Reset(10 * time.Second)
 
 			case <-ticker.C:
-				if len(users) == 0 {
+				if len(room.users) == 0 {
 					close(registrations)
 					slog.InfoContext(ctx, "cleanup", "room", roomName)
 					return
@@ -172,48 +230,241 @@ func createRoom(roomName string, ctx context.Context) chatRoom {
 	}
 }
 
-func websocketHandler(w http.ResponseWriter, r *http.Request) {
+// roomState is only used by its room's goroutine
+type roomState struct {
+	server   *chatServer
+	ctx      context.Context
+	roomName string
+	users    map[uuid.UUID]chan<- event
+	// names outlive users that were cut off for being slow, so that everyone hears they
+	// left once they deregister
+	names    map[uuid.UUID]string
+	presence map[uuid.UUID]*memberPresence
+	history  chan<- event
+	// said covers everything that can still be queued for the history writer
+	said []event
+}
+
+// send never waits, users who can't keep up are cut off
+func (r *roomState) send(userID uuid.UUID, ev event) {
+	user, ok := r.users[userID]
+	if !ok {
+		return
+	}
+	select {
+	case user <- ev:
+	default:
+		slog.ErrorContext(r.ctx, "unable to send messages to user, cutting them off", "userID", userID)
+		close(user)
+		delete(r.users, userID)
+	}
+}
+
+// broadcast sends ev to everyone in the room except one user, unless except is uuid.Nil
+func (r *roomState) broadcast(ev event, except uuid.UUID) {
+	for userID := range r.users {
+		if userID != except {
+			r.send(userID, ev)
+		}
+	}
+}
+
+// leave tells everyone, including the user if they're still connected, that they left and
+// then removes them. It's a no-op if they already left.
+func (r *roomState) leave(userID uuid.UUID) {
+	name, ok := r.names[userID]
+	if !ok {
+		return
+	}
+	delete(r.names, userID)
+	r.presence[userID].leave()
+	delete(r.presence, userID)
+	r.broadcast(newEvent(leaveEvent, userID, name, name+" left"), uuid.Nil)
+	if user, ok := r.users[userID]; ok {
+		close(user)
+		delete(r.users, userID)
+	}
+}
+
+// say queues ev for the room's history and sends it to everyone, including whoever said it.
+// If the history store has fallen behind ev is only lost from the history.
+func (r *roomState) say(ev event) {
+	select {
+	case r.history <- ev:
+	default:
+		slog.WarnContext(r.ctx, "history is behind, not recording message", "roomName", r.roomName, "eventID", ev.ID)
+	}
+	said := append(r.said, ev)
+	r.said = said[max(0, len(said)-historyQueue-1):]
+	r.broadcast(ev, uuid.Nil)
+}
+
+func (r *roomState) handle(message chatMessage) {
+	name, ok := r.names[message.userID]
+	if !ok {
+		// messages can still arrive from users that used /leave
+		return
+	}
+	switch {
+	case message.typing:
+		r.broadcast(newEvent(typingEvent, message.userID, name, ""), message.userID)
+	case strings.HasPrefix(message.text, "/"):
+		r.command(message.userID, name, message.text)
+	default:
+		r.say(newEvent(messageEvent, message.userID, name, message.text))
+	}
+}
+
+func (r *roomState) command(userID uuid.UUID, name, text string) {
+	command, arg, _ := strings.Cut(text, " ")
+	arg = strings.TrimSpace(arg)
+	reply := func(text string) {
+		r.send(userID, newEvent(systemEvent, userID, name, text))
+	}
+
+	switch command {
+	case "/nick":
+		newName, err := validName(arg)
+		if err != nil {
+			reply(err.Error())
+			return
+		}
+		r.names[userID] = newName
+		r.presence[userID].rename(r.roomName, userID, newName)
+		r.broadcast(newEvent(nickEvent, userID, newName, name+" is now "+newName), uuid.Nil)
+	case "/who":
+		ev := newEvent(systemEvent, userID, name, fmt.Sprintf("%d users in %v", len(r.names), r.roomName))
+		for memberID, memberName := range r.names {
+			ev.Members = append(ev.Members, member{UserID: memberID, Name: memberName})
+		}
+		slices.SortFunc(ev.Members, func(a, b member) int {
+			return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.UserID.String(), b.UserID.String()))
+		})
+		r.send(userID, ev)
+	case "/me":
+		if arg == "" {
+			reply("/me needs an action")
+			return
+		}
+		r.say(newEvent(emoteEvent, userID, name, arg))
+	case "/leave":
+		r.leave(userID)
+	default:
+		reply(fmt.Sprintf("unknown command %v, try /nick, /who, /me or /leave", command))
+	}
+}
+
+// replay reads the history a user asked for once they've joined, so that slow history
+// stores never hold up the room. Anything said since the user joined reaches them live
+// instead, and said fills in whatever the store hasn't caught up with.
+func (s *chatServer) replay(ctx context.Context, roomName string, last int, since time.Time, said []event) []event {
+	if last == 0 {
+		return nil
+	}
+	stored, err := s.history.Recent(ctx, roomName, last, since)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to read history", "roomName", roomName, "error", err)
+	}
+
+	seen := make(map[string]bool, len(stored))
+	for _, entry := range stored {
+		seen[entry.ID] = true
+	}
+	entries := stored
+	for _, entry := range said {
+		if !seen[entry.ID] {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b event) int { return a.Time.Compare(b.Time) })
+	return recent(entries, last, since)
+}
+
+// forward sends the replay and then live events until live is closed or send fails. Live
+// events that were said after joining but stored before the replay was read are skipped.
+func forward(replayed []event, live <-chan event, send func(event) error) {
+	seen := make(map[string]bool, len(replayed))
+	for _, ev := range replayed {
+		seen[ev.ID] = true
+		if send(ev) != nil {
+			return
+		}
+	}
+	for ev := range live {
+		if seen[ev.ID] {
+			continue
+		}
+		if send(ev) != nil {
+			return
+		}
+	}
+}
+
+func (s *chatServer) websocketHandler(w http.ResponseWriter, r *http.Request) {
 	userID := uuid.New()
 	slog.InfoContext(r.Context(), "recieved connection", "userID", userID)
 
+	name := defaultName(userID)
+	var err error
+	if r.URL.Query().Has("name") {
+		name, err = validName(r.URL.Query().Get("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	outbound := make(chan event, 100)
+	last, since, err := replayRequest(r.URL.Query(), cap(outbound))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "Could not upgrade to websocket", http.StatusInternalServerError)
 		return
 	}
 	defer conn.Close()
+	conn.SetReadLimit(maxMessageSize)
 
-	outbound := make(chan string, 100)
-	inboundCarrier := make(chan chan<- chatMessage, 1)
+	joinedCarrier := make(chan joinedRoom, 1)
 	defer func() {
-		registrationChan <- registration{
+		s.registrations <- registration{
 			add:      false,
 			roomName: r.URL.Path,
 			userID:   userID,
 		}
 	}()
-	registrationChan <- registration{
+	s.registrations <- registration{
 		add:      true,
 		roomName: r.URL.Path,
 		userID:   userID,
+		name:     name,
 		outbound: outbound,
-		inbound:  inboundCarrier,
+		joined:   joinedCarrier,
 	}
-	inbound, ok := <-inboundCarrier
+	joined, ok := <-joinedCarrier
 	if !ok {
 		http.Error(w, "Failed to join room", http.StatusInternalServerError)
 		return
 	}
+	inbound := joined.inbound
+	replayed := s.replay(r.Context(), r.URL.Path, last, since, joined.said)
 
 	go func() {
 		// This will close the connection if there's a write error or if the outbound channel is closed
 		defer conn.Close()
-		for msg := range outbound {
-			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
-				break
+		forward(replayed, outbound, func(ev event) error {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.Error("failed to encode chat event", "error", err, "userID", userID)
+				return nil
 			}
-		}
-		conn.WriteMessage(websocket.TextMessage, []byte("goodbye"))
+			return conn.WriteMessage(websocket.TextMessage, data)
+		})
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "goodbye"))
 	}()
 
 	for {
@@ -221,12 +472,38 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			break
 		}
-		strMessage := string(message)
-		if strMessage != "" {
-			inbound <- chatMessage{
-				userID: userID,
-				text:   strMessage,
-			}
+		msg, err := parseClientMessage(message)
+		if err != nil {
+			slog.InfoContext(r.Context(), "ignoring chat message", "error", err, "userID", userID)
+			continue
 		}
+		if msg.Type == typingEvent {
+			inbound <- chatMessage{userID: userID, typing: true}
+		} else if strings.TrimSpace(msg.Text) != "" {
+			inbound <- chatMessage{userID: userID, text: msg.Text}
+		}
+	}
+}
+
+func (s *chatServer) presenceHandler(w http.ResponseWriter, r *http.Request) {
+	if s.presence == nil {
+		http.Error(w, "presence is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	roomName := strings.TrimPrefix(r.URL.Path, "/presence")
+	members, err := s.presence.Members(r.Context(), roomName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,18 +17,18 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func resetGlobals() {
+func newTestServer() *chatServer {
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, nil)))
-	registrationChan = make(chan registration, 100)
+	return newChatServer(newMemoryHistory(100), nil)
 }
 
 func TestCreateRoom(t *testing.T) {
-	resetGlobals()
+	s := newTestServer()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	roomName := "test-room"
-	room := createRoom(roomName, ctx)
+	room := s.createRoom(roomName, ctx)
 
 	// Test that the room is initialized correctly
 	assert.NotNil(t, room.registrations)
@@ -34,15 +37,15 @@ func TestCreateRoom(t *testing.T) {
 
 	// Test adding a user to the room
 	userID := uuid.New()
-	outbound := make(chan string, 10)
-	inbound := make(chan chan<- chatMessage, 1)
+	outbound := make(chan event, 10)
+	joined := make(chan joinedRoom, 1)
 
 	reg := registration{
 		add:      true,
 		roomName: roomName,
 		userID:   userID,
 		outbound: outbound,
-		inbound:  inbound,
+		joined:   joined,
 	}
 
 	go func() {
@@ -50,8 +53,8 @@ func TestCreateRoom(t *testing.T) {
 	}()
 
 	select {
-	case inboundChan := <-inbound:
-		assert.NotNil(t, inboundChan)
+	case j := <-joined:
+		assert.NotNil(t, j.inbound)
 	case <-time.After(1 * time.Second):
 		t.Fatal("Timeout waiting for registration to be processed")
 	}
@@ -71,35 +74,35 @@ func TestCreateRoom(t *testing.T) {
 }
 
 func TestRoomController(t *testing.T) {
-	resetGlobals()
+	s := newTestServer()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	done := roomController(ctx)
+	done := s.roomController(ctx)
 
 	// Test that the controller initializes correctly
 	assert.NotNil(t, done)
 
 	// Test adding a registration
 	userID := uuid.New()
-	outbound := make(chan string, 10)
-	inbound := make(chan chan<- chatMessage, 1)
+	outbound := make(chan event, 10)
+	joined := make(chan joinedRoom, 1)
 
 	reg := registration{
 		add:      true,
 		roomName: "test-room",
 		userID:   userID,
 		outbound: outbound,
-		inbound:  inbound,
+		joined:   joined,
 	}
 
 	go func() {
-		registrationChan <- reg
+		s.registrations <- reg
 	}()
 
 	select {
-	case inboundChan := <-inbound:
-		assert.NotNil(t, inboundChan)
+	case j := <-joined:
+		assert.NotNil(t, j.inbound)
 	case <-time.After(1 * time.Second):
 		t.Fatal("Timeout waiting for registration to be processed")
 	}
@@ -115,19 +118,18 @@ func TestRoomController(t *testing.T) {
 }
 
 func TestWebsocketHandler(t *testing.T) {
-	resetGlobals()
+	s := newTestServer()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	roomController(ctx)
-	server := httptest.NewServer(http.HandlerFunc(websocketHandler))
+	s.roomController(ctx)
+	server := httptest.NewServer(http.HandlerFunc(s.websocketHandler))
 	defer server.Close()
-	outbound := make(chan string, 10)
-	inboundCarrier := make(chan<- chan<- chatMessage, 1)
-	registrationChan <- registration{
+	outbound := make(chan event, 10)
+	s.registrations <- registration{
 		add:      true,
 		userID:   uuid.Max,
 		outbound: outbound,
-		inbound:  inboundCarrier,
+		joined:   make(chan joinedRoom, 1),
 		roomName: "/test",
 	}
 	// Convert the test server URL to a WebSocket URL
@@ -143,6 +145,250 @@ func TestWebsocketHandler(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Test receiving a message
-	message := <-outbound
-	assert.Equal(t, "hello", string(message))
+	// registrations reach the room in any order, so both joins come before the message
+	joined := map[uuid.UUID]bool{}
+	joined[expectEvent(t, outbound, joinEvent).UserID] = true
+	joined[expectEvent(t, outbound, joinEvent).UserID] = true
+	message := expectEvent(t, outbound, messageEvent)
+	assert.Equal(t, "hello", message.Text)
+	assert.True(t, joined[message.UserID])
+	assert.True(t, joined[uuid.Max])
+	assert.NotEmpty(t, message.ID)
+	assert.False(t, message.Time.IsZero())
+}
+
+// expectEvent waits for the next event, which must be of type eventType
+func expectEvent(t *testing.T, outbound <-chan event, eventType eventType) event {
+	t.Helper()
+	select {
+	case ev, ok := <-outbound:
+		if !ok {
+			t.Fatalf("outbound closed waiting for %v", eventType)
+		}
+		assert.Equal(t, eventType, ev.Type, ev.Text)
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for %v", eventType)
+	}
+	return event{}
+}
+
+func expectNothing(t *testing.T, outbound <-chan event) {
+	t.Helper()
+	select {
+	case ev := <-outbound:
+		t.Fatalf("unexpected %v event %v", ev.Type, ev.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// joinRoom registers a user directly with room and replays history to them, as the
+// websocket handler does
+func joinRoom(t *testing.T, s *chatServer, room chatRoom, name string, last int) (uuid.UUID, <-chan event, chan<- chatMessage) {
+	t.Helper()
+	userID := uuid.New()
+	outbound := make(chan event, 10)
+	joined := make(chan joinedRoom, 1)
+	room.registrations <- registration{
+		add:      true,
+		roomName: room.roomName,
+		userID:   userID,
+		name:     name,
+		outbound: outbound,
+		joined:   joined,
+	}
+	j := <-joined
+	replayed := s.replay(context.Background(), room.roomName, last, time.Time{}, j.said)
+
+	events := make(chan event, 10)
+	go func() {
+		defer close(events)
+		forward(replayed, outbound, func(ev event) error {
+			events <- ev
+			return nil
+		})
+	}()
+	return userID, events, j.inbound
+}
+
+func TestForwardSkipsReplayedEvents(t *testing.T) {
+	a, b, c := event{ID: "a"}, event{ID: "b"}, event{ID: "c"}
+	live := make(chan event, 2)
+	live <- b
+	live <- c
+	close(live)
+
+	var sent []string
+	forward([]event{a, b}, live, func(ev event) error {
+		sent = append(sent, ev.ID)
+		return nil
+	})
+	assert.Equal(t, []string{"a", "b", "c"}, sent)
+}
+
+func TestCreateRoomReplaysHistory(t *testing.T) {
+	s := newTestServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	room := s.createRoom("/history", ctx)
+	aliceID, alice, inbound := joinRoom(t, s, room, "alice", defaultReplay)
+	expectEvent(t, alice, joinEvent)
+	inbound <- chatMessage{userID: aliceID, text: "one"}
+	inbound <- chatMessage{userID: aliceID, text: "/me two"}
+	one := expectEvent(t, alice, messageEvent)
+	assert.Equal(t, "one", one.Text)
+	expectEvent(t, alice, emoteEvent)
+
+	_, bob, _ := joinRoom(t, s, room, "bob", 1)
+	two := expectEvent(t, bob, emoteEvent)
+	assert.Equal(t, "two", two.Text)
+	assert.Equal(t, "alice", two.Name)
+	expectEvent(t, bob, joinEvent)
+
+	_, carol, _ := joinRoom(t, s, room, "carol", 0)
+	expectEvent(t, carol, joinEvent)
+	expectNothing(t, carol)
+}
+
+// stuckHistory never finishes appending until the append times out
+type stuckHistory struct {
+	historyStore
+}
+
+func (h stuckHistory) Append(ctx context.Context, room string, entry event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStuckHistoryDoesNotHoldUpRoom(t *testing.T) {
+	s := newTestServer()
+	s.history = stuckHistory{s.history}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	room := s.createRoom("/stuck", ctx)
+	aliceID, alice, inbound := joinRoom(t, s, room, "alice", 0)
+	expectEvent(t, alice, joinEvent)
+	// more than the history writer can queue
+	for i := range 200 {
+		inbound <- chatMessage{userID: aliceID, text: fmt.Sprint(i)}
+		assert.Equal(t, fmt.Sprint(i), expectEvent(t, alice, messageEvent).Text)
+	}
+
+	// the room hands over what the store hasn't caught up with
+	_, bob, _ := joinRoom(t, s, room, "bob", 2)
+	assert.Equal(t, "198", expectEvent(t, bob, messageEvent).Text)
+	assert.Equal(t, "199", expectEvent(t, bob, messageEvent).Text)
+	expectEvent(t, bob, joinEvent)
+}
+
+func TestRoomCommands(t *testing.T) {
+	s := newTestServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	room := s.createRoom("/commands", ctx)
+	aliceID, alice, inbound := joinRoom(t, s, room, "alice", 0)
+	expectEvent(t, alice, joinEvent)
+	bobID, bob, _ := joinRoom(t, s, room, "bob", 0)
+	assert.Equal(t, "bob", expectEvent(t, alice, joinEvent).Name)
+	expectEvent(t, bob, joinEvent)
+
+	// typing indicators skip the typist
+	inbound <- chatMessage{userID: aliceID, typing: true}
+	typing := expectEvent(t, bob, typingEvent)
+	assert.Equal(t, aliceID, typing.UserID)
+	expectNothing(t, alice)
+
+	inbound <- chatMessage{userID: bobID, text: "/nick robert"}
+	nick := expectEvent(t, alice, nickEvent)
+	assert.Equal(t, "robert", nick.Name)
+	assert.Equal(t, "bob is now robert", nick.Text)
+	expectEvent(t, bob, nickEvent)
+
+	inbound <- chatMessage{userID: bobID, text: "/nick  "}
+	expectEvent(t, bob, systemEvent)
+	inbound <- chatMessage{userID: bobID, text: "/dance"}
+	expectEvent(t, bob, systemEvent)
+
+	inbound <- chatMessage{userID: aliceID, text: "/who"}
+	who := expectEvent(t, alice, systemEvent)
+	assert.Equal(t, []member{{UserID: aliceID, Name: "alice"}, {UserID: bobID, Name: "robert"}}, who.Members)
+	expectNothing(t, bob)
+
+	inbound <- chatMessage{userID: bobID, text: "/me waves"}
+	emote := expectEvent(t, alice, emoteEvent)
+	assert.Equal(t, "robert", emote.Name)
+	assert.Equal(t, "waves", emote.Text)
+	assert.Equal(t, emote, expectEvent(t, bob, emoteEvent))
+
+	inbound <- chatMessage{userID: bobID, text: "/leave"}
+	leave := expectEvent(t, alice, leaveEvent)
+	assert.Equal(t, bobID, leave.UserID)
+	assert.Equal(t, "robert left", leave.Text)
+	assert.Equal(t, leave, expectEvent(t, bob, leaveEvent))
+	_, ok := <-bob
+	assert.False(t, ok)
+
+	// deregistering after /leave doesn't announce it twice
+	room.registrations <- registration{roomName: "/commands", userID: bobID}
+	expectNothing(t, alice)
+}
+
+func TestWebsocketProtocol(t *testing.T) {
+	s := newTestServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.roomController(ctx)
+	server := httptest.NewServer(http.HandlerFunc(s.websocketHandler))
+	defer server.Close()
+	wsURL := "ws" + server.URL[len("http"):] + "/protocol"
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?name=", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?name=alice", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	read := func() event {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		var ev event
+		assert.NoError(t, json.Unmarshal(data, &ev))
+		return ev
+	}
+
+	join := read()
+	assert.Equal(t, joinEvent, join.Type)
+	assert.Equal(t, "alice", join.Name)
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"message","text":"hi"}`)))
+	message := read()
+	assert.Equal(t, messageEvent, message.Type)
+	assert.Equal(t, "hi", message.Text)
+	assert.Equal(t, join.UserID, message.UserID)
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("plain text")))
+	assert.Equal(t, "plain text", read().Text)
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("/leave")))
+	assert.Equal(t, leaveEvent, read().Type)
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+
+	s.history.Append(ctx, "/other", newEvent(messageEvent, uuid.New(), "bob", "earlier"))
+	conn, _, err = websocket.DefaultDialer.Dial(strings.Replace(wsURL, "/protocol", "/other", 1), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "earlier", read().Text)
+	assert.True(t, strings.HasPrefix(read().Name, "guest-"))
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", maxMessageSize+1))))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/labiraus/go-utils/pkg/redisutil"
+)
+
+// memberPresence publishes one user's presence in order, off the room goroutine, so that a
+// slow redis doesn't hold up the room
+type memberPresence struct {
+	updates chan func(ctx context.Context)
+	// session is only used by the updates goroutine
+	session *redisutil.Session
+}
+
+// joinPresence returns nil when presence isn't configured
+func joinPresence(ctx context.Context, presence *redisutil.Presence, roomName string, userID uuid.UUID, name string) *memberPresence {
+	if presence == nil {
+		return nil
+	}
+	p := &memberPresence{updates: make(chan func(ctx context.Context), 10)}
+	p.updates <- func(ctx context.Context) {
+		session, err := presence.Join(ctx, roomName, userID.String(), map[string]string{"name": name})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to publish presence", "userID", userID, "roomName", roomName, "error", err)
+			return
+		}
+		p.session = session
+	}
+	go func() {
+		for update := range p.updates {
+			update(ctx)
+		}
+		if p.session != nil {
+			p.session.Leave(ctx)
+		}
+	}()
+	return p
+}
+
+// rename queues a name change. It's dropped, rather than holding up the room, if redis has
+// fallen that far behind.
+func (p *memberPresence) rename(roomName string, userID uuid.UUID, name string) {
+	if p == nil {
+		return
+	}
+	update := func(ctx context.Context) {
+		if p.session == nil {
+			return
+		}
+		if err := p.session.SetMetadata(ctx, map[string]string{"name": name}); err != nil {
+			slog.ErrorContext(ctx, "failed to publish presence", "userID", userID, "roomName", roomName, "error", err)
+		}
+	}
+	select {
+	case p.updates <- update:
+	default:
+		slog.Warn("presence update dropped", "userID", userID, "roomName", roomName)
+	}
+}
+
+// leave queues the leave after any pending updates, p can't be used afterwards
+func (p *memberPresence) leave() {
+	if p != nil {
+		close(p.updates)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labiraus/go-utils/pkg/redisutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func startPresence(t *testing.T) *redisutil.Presence {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client, err := redisutil.New(context.Background(), map[string]redisutil.RedisConfig{
+		"redis": {Host: server.Host(), Port: server.Port()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return redisutil.NewPresence(client, time.Minute)
+}
+
+func TestRoomPublishesPresence(t *testing.T) {
+	s := newTestServer()
+	presence := startPresence(t)
+	s.presence = presence
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	room := s.createRoom("/presence", ctx)
+	aliceID, alice, inbound := joinRoom(t, s, room, "alice", 0)
+	expectEvent(t, alice, joinEvent)
+
+	assert.Eventually(t, func() bool {
+		members, err := presence.Members(ctx, "/presence")
+		return err == nil && len(members) == 1 &&
+			members[0].ID == aliceID.String() && members[0].Metadata["name"] == "alice"
+	}, time.Second, 10*time.Millisecond)
+
+	inbound <- chatMessage{userID: aliceID, text: "/nick al"}
+	expectEvent(t, alice, nickEvent)
+	assert.Eventually(t, func() bool {
+		members, err := presence.Members(ctx, "/presence")
+		return err == nil && len(members) == 1 && members[0].Metadata["name"] == "al"
+	}, time.Second, 10*time.Millisecond)
+
+	inbound <- chatMessage{userID: aliceID, text: "/leave"}
+	expectEvent(t, alice, leaveEvent)
+	assert.Eventually(t, func() bool {
+		members, err := presence.Members(ctx, "/presence")
+		return err == nil && len(members) == 0
+	}, time.Second, 10*time.Millisecond)
+}
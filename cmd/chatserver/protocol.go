@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type eventType string
+
+const (
+	// messageEvent and emoteEvent are said by users and kept in the room's history
+	messageEvent eventType = "message"
+	emoteEvent   eventType = "emote"
+	joinEvent    eventType = "join"
+	leaveEvent   eventType = "leave"
+	nickEvent    eventType = "nick"
+	typingEvent  eventType = "typing"
+	// systemEvent is only sent to one user, answering a command or reporting an error
+	systemEvent eventType = "system"
+)
+
+// maxNameLength is the longest display name, in characters
+const maxNameLength = 32
+
+// maxMessageSize is the largest websocket message a client may send, in bytes. Connections
+// that send more are closed.
+const maxMessageSize = 16 * 1024
+
+// event is everything the server sends to clients, as JSON text messages. Messages are
+// also sent back to the user who said them so that they learn the ID and server time.
+type event struct {
+	ID     string    `json:"id"`
+	Type   eventType `json:"type"`
+	UserID uuid.UUID `json:"userId,omitzero"`
+	Name   string    `json:"name,omitempty"`
+	Text   string    `json:"text,omitempty"`
+	Time   time.Time `json:"time"`
+	// Members is only set on the answer to /who
+	Members []member `json:"members,omitempty"`
+}
+
+type member struct {
+	UserID uuid.UUID `json:"userId"`
+	Name   string    `json:"name"`
+}
+
+func newEvent(t eventType, userID uuid.UUID, name, text string) event {
+	return event{
+		ID:     uuid.NewString(),
+		Type:   t,
+		UserID: userID,
+		Name:   name,
+		Text:   text,
+		Time:   time.Now().UTC(),
+	}
+}
+
+// clientMessage is what clients send. Text starting with a slash is a command.
+type clientMessage struct {
+	Type eventType `json:"type"`
+	Text string    `json:"text,omitempty"`
+}
+
+// parseClientMessage accepts the JSON protocol and, for simple clients, plain text
+// messages
+func parseClientMessage(data []byte) (clientMessage, error) {
+	var msg clientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return clientMessage{Type: messageEvent, Text: string(data)}, nil
+	}
+	switch msg.Type {
+	case "":
+		msg.Type = messageEvent
+	case messageEvent, typingEvent:
+	default:
+		return clientMessage{}, fmt.Errorf("unsupported message type: %v", msg.Type)
+	}
+	return msg, nil
+}
+
+// validName trims name and reports whether it can be used as a display name
+func validName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", fmt.Errorf("name can't be empty")
+	case len([]rune(name)) > maxNameLength:
+		return "", fmt.Errorf("name can't be longer than %d characters", maxNameLength)
+	}
+	return name, nil
+}
+
+// defaultName is used when a user connects without ?name=
+func defaultName(userID uuid.UUID) string {
+	return "guest-" + userID.String()[:8]
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseClientMessage(t *testing.T) {
+	msg, err := parseClientMessage([]byte(`{"type":"typing"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, clientMessage{Type: typingEvent}, msg)
+
+	msg, err = parseClientMessage([]byte(`{"text":"hi"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, clientMessage{Type: messageEvent, Text: "hi"}, msg)
+
+	msg, err = parseClientMessage([]byte("/me waves"))
+	assert.NoError(t, err)
+	assert.Equal(t, clientMessage{Type: messageEvent, Text: "/me waves"}, msg)
+
+	_, err = parseClientMessage([]byte(`{"type":"join"}`))
+	assert.Error(t, err)
+}
+
+func TestValidName(t *testing.T) {
+	name, err := validName("  alice ")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", name)
+
+	_, err = validName(" ")
+	assert.Error(t, err)
+	_, err = validName(strings.Repeat("é", maxNameLength))
+	assert.NoError(t, err)
+	_, err = validName(strings.Repeat("a", maxNameLength+1))
+	assert.Error(t, err)
+}
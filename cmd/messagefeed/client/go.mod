@@ -3,8 +3,11 @@ module github.com/labiraus/go-utils/cmd/messagefeed/client
 go 1.25.5
 
 require (
-	github.com/gorilla/websocket v1.5.3
 	github.com/labiraus/go-utils/pkg/base v0.0.0-20250724213018-3e152debf928
+	github.com/labiraus/go-utils/pkg/websocketutil v0.0.0-20250724213018-3e152debf928
 )
 
-require github.com/google/uuid v1.6.0 // indirect
+require (
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+)
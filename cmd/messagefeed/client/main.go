@@ -7,8 +7,8 @@ import (
 	"log/slog"
 	"os"
 
-	"github.com/gorilla/websocket"
 	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/labiraus/go-utils/pkg/websocketutil"
 )
 
 var port = flag.Int("port", 8080, "the HTTP port to listen to")
@@ -41,27 +41,18 @@ func Listen(ctx context.Context) <-chan struct{} {
 	go func() {
 		defer close(done)
 		url := fmt.Sprintf("ws://localhost:%d/listen", *port)
-		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
-		if err != nil {
-			slog.ErrorContext(ctx, "failed to connect to websocket", "error", err)
-			return
-		}
-		defer conn.Close()
+		client := websocketutil.Connect(ctx, url, websocketutil.ClientConfig{})
 		go func() {
-			defer conn.Close()
-			<-ctx.Done()
-		}()
-
-		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				select {
-				case <-ctx.Done():
-				default:
-					slog.ErrorContext(ctx, "read error", "error", err)
+			for event := range client.States() {
+				if event.Err != nil {
+					slog.WarnContext(ctx, fmt.Sprintf("websocket %v", event.State), "attempt", event.Attempt, "error", event.Err)
+					continue
 				}
-				break
+				slog.InfoContext(ctx, fmt.Sprintf("websocket %v", event.State))
 			}
+		}()
+
+		for message := range client.Inbound() {
 			fmt.Fprintln(os.Stdout, string(message))
 		}
 	}()
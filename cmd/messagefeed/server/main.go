@@ -8,6 +8,7 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/labiraus/go-utils/cmd/messagefeed/types"
 	"github.com/labiraus/go-utils/pkg/api"
@@ -63,7 +64,7 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/listen", webSocketHandler)
-	mux.HandleFunc("/post", messageHandler)
+	mux.Handle("/post", api.Idempotency(api.NewMemoryIdempotencyStore(ctx), 24*time.Hour, http.HandlerFunc(messageHandler)))
 	api.Start(ctx, mux, *port)
 	conn, err := grpc.NewClient(fmt.Sprintf("%v:%d", host, *grpcPort), grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
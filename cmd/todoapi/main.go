@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/labiraus/go-utils/pkg/api"
 	"github.com/labiraus/go-utils/pkg/base"
@@ -25,8 +26,9 @@ func main() {
 		}
 	}()
 
+	idempotencyStore := api.NewMemoryIdempotencyStore(ctx)
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /todo", postHandler)
+	mux.Handle("POST /todo", api.Idempotency(idempotencyStore, 24*time.Hour, http.HandlerFunc(postHandler)))
 	mux.HandleFunc("GET /todo", getHandler)
 	mux.HandleFunc("DELETE /todo", deleteHandler)
 
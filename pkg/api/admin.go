@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/labiraus/go-utils/pkg/base"
+)
+
+type buildInfo struct {
+	Service   string            `json:"service"`
+	GoVersion string            `json:"goVersion"`
+	Path      string            `json:"path,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Settings  map[string]string `json:"settings,omitempty"`
+}
+
+// StartAdmin serves the operational endpoints on a dedicated port: /readiness, /liveness,
+// /debug/pprof/, /loglevel and /buildinfo. Anything already registered on mux, such as
+// prometheusutil's /metrics, is served alongside them.
+func StartAdmin(ctx context.Context, mux *http.ServeMux, port int) <-chan struct{} {
+	registerAdmin(mux)
+	return serve(ctx, mux, port)
+}
+
+func registerAdmin(mux *http.ServeMux) {
+	registerHealth(mux)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("GET /loglevel", getLogLevelHandler)
+	mux.HandleFunc("PUT /loglevel", setLogLevelHandler)
+	mux.HandleFunc("GET /buildinfo", buildInfoHandler)
+}
+
+func getLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(base.LogLevel.Level().String()))
+}
+
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var level slog.Level
+	if err = level.UnmarshalText([]byte(strings.TrimSpace(string(body)))); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	base.LogLevel.Set(level)
+	slog.InfoContext(r.Context(), "log level changed", "level", level.String())
+	w.Write([]byte(level.String()))
+}
+
+func buildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo{
+		Service:   base.ServiceName,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Path = bi.Main.Path
+		info.Version = bi.Main.Version
+		info.Settings = make(map[string]string, len(bi.Settings))
+		for _, setting := range bi.Settings {
+			info.Settings[setting.Key] = setting.Value
+		}
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
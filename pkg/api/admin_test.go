@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// markReady closes base.Ready once, whichever test gets there first
+func markReady() {
+	select {
+	case <-base.Ready:
+	default:
+		close(base.Ready)
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	markReady()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	})
+	registerAdmin(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, _ := get("/readiness")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get("/liveness")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := get("/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "metrics", body)
+
+	code, body = get("/loglevel")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, base.LogLevel.Level().String(), body)
+
+	code, body = get("/buildinfo")
+	assert.Equal(t, http.StatusOK, code)
+	var info buildInfo
+	assert.NoError(t, json.Unmarshal([]byte(body), &info))
+	assert.NotEmpty(t, info.GoVersion)
+}
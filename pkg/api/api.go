@@ -10,10 +10,24 @@ import (
 	"github.com/labiraus/go-utils/pkg/base"
 )
 
+// Start serves mux on port alongside the health endpoints. Use StartPublic together
+// with StartAdmin to keep health, metrics and debug endpoints off the public port.
 func Start(ctx context.Context, mux *http.ServeMux, port int) <-chan struct{} {
+	registerHealth(mux)
+	return serve(ctx, mux, port)
+}
+
+// StartPublic serves mux on port without registering any of the operational endpoints.
+func StartPublic(ctx context.Context, mux *http.ServeMux, port int) <-chan struct{} {
+	return serve(ctx, mux, port)
+}
+
+func registerHealth(mux *http.ServeMux) {
 	mux.HandleFunc("/readiness", readinessHandler)
 	mux.HandleFunc("/liveness", livelinessHandler)
+}
 
+func serve(ctx context.Context, mux *http.ServeMux, port int) <-chan struct{} {
 	done := make(chan struct{})
 	srv := &http.Server{
 		Addr:    fmt.Sprintf("0.0.0.0:%d", port),
@@ -60,6 +74,10 @@ func contextMiddleware(ctx context.Context, next http.Handler) http.Handler {
 
 func readinessHandler(w http.ResponseWriter, r *http.Request) {
 	<-base.Ready
+	if err := base.CheckReadiness(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadinessReportsFailingChecks(t *testing.T) {
+	markReady()
+	var checkErr error
+	base.AddReadinessCheck("test", func() error { return checkErr })
+	defer base.RemoveReadinessCheck("test")
+
+	rec := httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	checkErr = errors.New("subscription events is draining")
+	rec = httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "draining")
+}
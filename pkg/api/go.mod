@@ -5,4 +5,11 @@ go 1.25.5
 require (
 	github.com/google/uuid v1.6.0
 	github.com/labiraus/go-utils/pkg/base v0.0.0-20250724115032-2ddb5ef39f50
+	github.com/stretchr/testify v1.10.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
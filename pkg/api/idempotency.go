@@ -0,0 +1,279 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyCleanupPeriod = time.Minute
+	defaultIdempotencyTTL    = 24 * time.Hour
+)
+
+// idempotencyLockTimeout bounds how long a crashed replica can hold a key in flight, the
+// reservation is extended every idempotencyLockTimeout/3 while the handler runs
+var idempotencyLockTimeout = time.Minute
+
+// IdempotencyStore holds the first response for each idempotency key.
+//
+// Reserve claims key for ttl while the request is in flight. If a response has already been saved for key it is returned
+// with reserved false; if another request holds the key both stored and reserved are empty.
+// Extend pushes the expiry of a reservation out to ttl from now and leaves saved responses alone.
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, key string, ttl time.Duration) (stored []byte, reserved bool, err error)
+	Extend(ctx context.Context, key string, ttl time.Duration) error
+	Save(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
+
+type storedResponse struct {
+	RequestHash string      `json:"requestHash"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// Idempotency replays the first response to a mutating request carrying an Idempotency-Key
+// header for any retry within ttl. Retries that arrive while the first request is still in
+// flight get a 409, and reusing a key with a different body gets a 422. Server errors are
+// not stored so that the client can retry them.
+func Idempotency(store IdempotencyStore, ttl time.Duration, next http.Handler) http.Handler {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" || !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		args := []any{"idempotencyKey", idempotencyKey}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(hash[:])
+
+		key := r.Method + " " + r.URL.Path + " " + idempotencyKey
+		stored, reserved, err := store.Reserve(r.Context(), key, idempotencyLockTimeout)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to reserve idempotency key: "+err.Error(), args...)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !reserved {
+			if stored == nil {
+				http.Error(w, "request with this idempotency key is already in progress", http.StatusConflict)
+				return
+			}
+			replay(w, r, stored, requestHash)
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := store.Release(context.WithoutCancel(r.Context()), key); err != nil {
+				slog.ErrorContext(r.Context(), "failed to release idempotency key: "+err.Error(), args...)
+			}
+		}()
+		// deferred after the release so the reservation stops being extended before it is released
+		defer keepReserved(r.Context(), store, key, args)()
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		if recorder.status >= http.StatusInternalServerError {
+			return
+		}
+
+		data, err := json.Marshal(storedResponse{
+			RequestHash: requestHash,
+			Status:      recorder.status,
+			Header:      recorder.Header().Clone(),
+			Body:        recorder.body.Bytes(),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to marshal idempotent response: "+err.Error(), args...)
+			return
+		}
+		if err = store.Save(context.WithoutCancel(r.Context()), key, data, ttl); err != nil {
+			slog.ErrorContext(r.Context(), "failed to save idempotent response: "+err.Error(), args...)
+			return
+		}
+		completed = true
+	})
+}
+
+// keepReserved extends the reservation on key until the returned function is called, so that
+// a handler running longer than idempotencyLockTimeout isn't run again by a retry.
+func keepReserved(ctx context.Context, store IdempotencyStore, key string, args []any) func() {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(idempotencyLockTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := store.Extend(ctx, key, idempotencyLockTimeout); err != nil && ctx.Err() == nil {
+					slog.WarnContext(ctx, "failed to extend idempotency key: "+err.Error(), args...)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func replay(w http.ResponseWriter, r *http.Request, stored []byte, requestHash string) {
+	var response storedResponse
+	if err := json.Unmarshal(stored, &response); err != nil {
+		slog.ErrorContext(r.Context(), "failed to unmarshal idempotent response: "+err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if response.RequestHash != requestHash {
+		http.Error(w, "idempotency key reused with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	for k, v := range response.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(response.Status)
+	w.Write(response.Body)
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type MemoryIdempotencyStore struct {
+	mux     sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// NewMemoryIdempotencyStore returns a process-local IdempotencyStore which purges expired
+// keys until ctx is cancelled.
+func NewMemoryIdempotencyStore(ctx context.Context) *MemoryIdempotencyStore {
+	store := &MemoryIdempotencyStore{entries: make(map[string]memoryEntry)}
+
+	go func() {
+		ticker := time.NewTicker(idempotencyCleanupPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				store.mux.Lock()
+				for key, entry := range store.entries {
+					if now.After(entry.expires) {
+						delete(store.entries, key)
+					}
+				}
+				store.mux.Unlock()
+			}
+		}
+	}()
+
+	return store
+}
+
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, key string, ttl time.Duration) ([]byte, bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	entry, ok := s.entries[key]
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, false, nil
+	}
+	s.entries[key] = memoryEntry{expires: time.Now().Add(ttl)}
+	return nil, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Extend(ctx context.Context, key string, ttl time.Duration) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	entry, ok := s.entries[key]
+	if ok && entry.value == nil {
+		entry.expires = time.Now().Add(ttl)
+		s.entries[key] = entry
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Save(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
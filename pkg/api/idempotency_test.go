@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyReplaysFirstResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	handler := Idempotency(NewMemoryIdempotencyStore(ctx), time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("X-Test", "value")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/todo", strings.NewReader(`{"item":1}`))
+		req.Header.Set(IdempotencyKeyHeader, "abc")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, "created", rec.Body.String())
+		assert.Equal(t, "value", rec.Header().Get("X-Test"))
+	}
+	assert.Equal(t, int32(1), calls.Load())
+
+	req := httptest.NewRequest(http.MethodPost, "/todo", strings.NewReader(`{"item":2}`))
+	req.Header.Set(IdempotencyKeyHeader, "abc")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestIdempotencyRejectsConcurrentDuplicate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := Idempotency(NewMemoryIdempotencyStore(ctx), time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/todo", nil)
+		req.Header.Set(IdempotencyKeyHeader, "abc")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	req := httptest.NewRequest(http.MethodPost, "/todo", nil)
+	req.Header.Set(IdempotencyKeyHeader, "abc")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	close(release)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestIdempotencyDoesNotStoreServerErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	handler := Idempotency(NewMemoryIdempotencyStore(ctx), time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	for _, expected := range []int{http.StatusInternalServerError, http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, "/todo", nil)
+		req.Header.Set(IdempotencyKeyHeader, "abc")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, expected, rec.Code)
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestIdempotencyKeepsSlowRequestReserved(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lockTimeout := idempotencyLockTimeout
+	idempotencyLockTimeout = 30 * time.Millisecond
+	defer func() { idempotencyLockTimeout = lockTimeout }()
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := Idempotency(NewMemoryIdempotencyStore(ctx), time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+	}))
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		req := httptest.NewRequest(http.MethodPost, "/todo", nil)
+		req.Header.Set(IdempotencyKeyHeader, "abc")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+	time.Sleep(5 * idempotencyLockTimeout)
+
+	req := httptest.NewRequest(http.MethodPost, "/todo", nil)
+	req.Header.Set(IdempotencyKeyHeader, "abc")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	close(release)
+	<-finished
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, int32(1), calls.Load())
+}
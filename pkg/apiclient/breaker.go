@@ -0,0 +1,74 @@
+package apiclient
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	closedState = iota
+	openState
+	halfOpenState
+)
+
+// breaker opens after threshold consecutive failures. Once openTimeout has passed a single
+// trial request is let through, and its outcome decides whether the circuit closes again.
+type breaker struct {
+	mux         sync.Mutex
+	state       int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+	threshold   int
+	openTimeout time.Duration
+}
+
+func (b *breaker) allow() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	switch b.state {
+	case openState:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.state = halfOpenState
+		b.probing = true
+		return true
+	case halfOpenState:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// release gives back a trial slot that was never used
+func (b *breaker) release() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.probing = false
+}
+
+// record returns 1 if the circuit is open after the result, for the circuit gauge
+func (b *breaker) record(success bool) float64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.probing = false
+	if success {
+		b.state = closedState
+		b.failures = 0
+		return 0
+	}
+
+	b.failures++
+	if b.state == halfOpenState || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = openState
+		b.openedAt = time.Now()
+		return 1
+	}
+	return 0
+}
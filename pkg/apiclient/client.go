@@ -0,0 +1,256 @@
+package apiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/labiraus/go-utils/pkg/prometheusutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type Config struct {
+	// Timeout applies to each attempt rather than the request as a whole
+	Timeout     time.Duration
+	MaxRetries  int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// FailureThreshold consecutive failures against a host open its circuit for OpenTimeout
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+type transport struct {
+	next     http.RoundTripper
+	config   Config
+	breakers map[string]*breaker
+	rwMux    sync.RWMutex
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+var (
+	metricsOnce     sync.Once
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	retriesTotal    *prometheus.CounterVec
+	circuitOpen     *prometheus.GaugeVec
+)
+
+func DefaultConfig() Config {
+	return Config{
+		Timeout:          10 * time.Second,
+		MaxRetries:       3,
+		BaseBackoff:      100 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+	}
+}
+
+// New returns an http.Client for calling other services. It forwards the trace ID from
+// the request context, retries idempotent requests with backoff and stops calling hosts
+// whose circuit is open.
+func New(config Config) *http.Client {
+	return &http.Client{Transport: NewTransport(http.DefaultTransport, config)}
+}
+
+func NewTransport(next http.RoundTripper, config Config) http.RoundTripper {
+	metricsOnce.Do(startMetrics)
+	return &transport{
+		next:     next,
+		config:   config,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+func startMetrics() {
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: base.ServiceName + "_client_requests_total",
+		Help: "The total number of outbound request attempts",
+	}, []string{"host", "method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    base.ServiceName + "_client_request_duration_seconds",
+		Help:    "The duration of outbound request attempts",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "method"})
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: base.ServiceName + "_client_retries_total",
+		Help: "The total number of outbound request retries",
+	}, []string{"host", "method"})
+	circuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: base.ServiceName + "_client_circuit_open",
+		Help: "Whether the circuit breaker for a host is open",
+	}, []string{"host"})
+
+	prometheusutil.Register(requestsTotal, requestDuration, retriesTotal, circuitOpen)
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Host
+	hostBreaker := t.breaker(host)
+
+	attempts := 1
+	if isRetryable(req) {
+		attempts += t.config.MaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if !hostBreaker.allow() {
+			requestsTotal.WithLabelValues(host, req.Method, "circuit_open").Inc()
+			return nil, fmt.Errorf("%w: %v", ErrCircuitOpen, host)
+		}
+
+		attemptReq, cancel, err := t.prepare(req, attempt)
+		if err != nil {
+			hostBreaker.release()
+			return nil, err
+		}
+
+		start := time.Now()
+		resp, err := t.next.RoundTrip(attemptReq)
+		requestDuration.WithLabelValues(host, req.Method).Observe(time.Since(start).Seconds())
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		requestsTotal.WithLabelValues(host, req.Method, code).Inc()
+		circuitOpen.WithLabelValues(host).Set(hostBreaker.record(err == nil && resp.StatusCode < http.StatusInternalServerError))
+
+		if (err == nil && !retryableStatus(resp.StatusCode)) || attempt+1 >= attempts || ctx.Err() != nil {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		wait := t.backoff(attempt)
+		if err == nil {
+			if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > wait {
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+
+		slog.DebugContext(ctx, "retrying request", "host", host, "method", req.Method, "attempt", attempt+1, "code", code)
+		retriesTotal.WithLabelValues(host, req.Method).Inc()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (t *transport) prepare(req *http.Request, attempt int) (*http.Request, context.CancelFunc, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if t.config.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), t.config.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+
+	attemptReq := req.Clone(ctx)
+	if traceID, ok := req.Context().Value(base.TraceID).(string); ok && attemptReq.Header.Get(string(base.TraceID)) == "" {
+		attemptReq.Header.Set(string(base.TraceID), traceID)
+	}
+
+	if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("failed to rewind request body: %w", err)
+		}
+		attemptReq.Body = body
+	}
+	return attemptReq, cancel, nil
+}
+
+func (t *transport) breaker(host string) *breaker {
+	t.rwMux.RLock()
+	b, ok := t.breakers[host]
+	t.rwMux.RUnlock()
+	if ok {
+		return b
+	}
+
+	t.rwMux.Lock()
+	defer t.rwMux.Unlock()
+	if b, ok = t.breakers[host]; !ok {
+		b = &breaker{threshold: t.config.FailureThreshold, openTimeout: t.config.OpenTimeout}
+		t.breakers[host] = b
+	}
+	return b
+}
+
+// backoff uses full jitter so that callers retrying the same host spread out
+func (t *transport) backoff(attempt int) time.Duration {
+	wait := t.config.BaseBackoff << attempt
+	if wait <= 0 || (t.config.MaxBackoff > 0 && wait > t.config.MaxBackoff) {
+		wait = t.config.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return rand.N(wait)
+}
+
+// isRetryable only allows requests that are safe to repeat: idempotent methods, or any
+// method carrying an Idempotency-Key, and only if the body can be replayed.
+func isRetryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+module github.com/labiraus/go-utils/pkg/apiclient
+
+go 1.25.5
+
+require (
+	github.com/labiraus/go-utils/pkg/base v0.0.0-20250724115032-2ddb5ef39f50
+	github.com/labiraus/go-utils/pkg/prometheusutil v0.0.0-20250724213018-3e152debf928
+	github.com/prometheus/client_golang v1.19.1
+	github.com/stretchr/testify v1.10.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	google.golang.org/protobuf v1.36.6 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
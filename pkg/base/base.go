@@ -2,10 +2,13 @@ package base
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
+	"sync"
 
 	"github.com/google/uuid"
 )
@@ -17,8 +20,12 @@ const TraceID TraceIDKey = "trace_id"
 var (
 	Ready       = make(chan struct{})
 	ServiceName string
+	LogLevel    = new(slog.LevelVar)
 	tagLogger   *slog.Logger
 	tagList     = map[string]bool{"test": true}
+
+	readinessMux    sync.RWMutex
+	readinessChecks = make(map[string]func() error)
 )
 
 type customHandler struct {
@@ -56,7 +63,7 @@ func (h *wrappedHandler) Handle(ctx context.Context, r slog.Record) error {
 
 func Start(serviceName string) context.Context {
 	ServiceName = serviceName
-	baseHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true})
+	baseHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true, Level: LogLevel})
 	handler := &customHandler{Handler: baseHandler.WithGroup(serviceName)}
 	logger := slog.New(handler)
 	slog.SetDefault(logger)
@@ -98,6 +105,43 @@ func LogTags(ctx context.Context, level slog.Level, msg string, tags ...string)
 	}
 }
 
+// AddReadinessCheck registers a check that has to pass, once Ready is closed, for the
+// service to report ready. Adding a check under an existing name replaces it.
+func AddReadinessCheck(name string, check func() error) {
+	readinessMux.Lock()
+	defer readinessMux.Unlock()
+	readinessChecks[name] = check
+}
+
+func RemoveReadinessCheck(name string) {
+	readinessMux.Lock()
+	defer readinessMux.Unlock()
+	delete(readinessChecks, name)
+}
+
+// CheckReadiness runs every registered check and joins their errors
+func CheckReadiness() error {
+	readinessMux.RLock()
+	names := make([]string, 0, len(readinessChecks))
+	for name := range readinessChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]func() error, len(names))
+	for i, name := range names {
+		checks[i] = readinessChecks[name]
+	}
+	readinessMux.RUnlock()
+
+	var errs []error
+	for _, check := range checks {
+		if err := check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func GetEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -15,8 +15,14 @@ import (
 var (
 	opsProcessed *prometheus.CounterVec
 	opDuration   *prometheus.HistogramVec
+	registry     = prometheus.NewRegistry()
 )
 
+// Register adds collectors to the registry served on /metrics.
+func Register(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
 func IncrementProcessed(method string, state string) {
 	opsProcessed.WithLabelValues(method, state).Inc()
 }
@@ -36,8 +42,6 @@ func Start(mux *http.ServeMux) {
 		Help: "The total number of processed events",
 	}, []string{"method", "state"})
 
-	registry := prometheus.NewRegistry()
-
 	registry.MustRegister(
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
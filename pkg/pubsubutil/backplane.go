@@ -0,0 +1,31 @@
+package pubsubutil
+
+import (
+	"context"
+)
+
+// Backplane relays messages through a Broker topic, which makes it a
+// websocketutil.Backplane. Every replica has to subscribe with its own subscription, for
+// instance by setting Topic.Subscription from the pod name, otherwise replicas share the
+// messages instead of each receiving all of them.
+type Backplane struct {
+	broker  Broker
+	topicID string
+}
+
+func NewBackplane(broker Broker, topicID string) *Backplane {
+	return &Backplane{broker: broker, topicID: topicID}
+}
+
+func (b *Backplane) Publish(ctx context.Context, data []byte) error {
+	_, err := b.broker.Publish(ctx, b.topicID, &Message{Data: data})
+	return err
+}
+
+// Subscribe acks every message once handler returns; a relayed push is not worth retrying
+func (b *Backplane) Subscribe(ctx context.Context, handler func(data []byte)) error {
+	return b.broker.Subscribe(ctx, b.topicID, func(ctx context.Context, msg *Message) {
+		defer msg.Ack()
+		handler(msg.Data)
+	})
+}
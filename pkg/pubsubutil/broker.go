@@ -0,0 +1,81 @@
+package pubsubutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	GoogleBroker = "google"
+	RedisBroker  = "redis"
+	NatsBroker   = "nats"
+	MemoryBroker = "memory"
+)
+
+// Broker is a transport independent publish/subscribe client. Topic IDs are keys into
+// PubsubConfig.Topics, exactly as they are for Subscribe and GetTopic.
+type Broker interface {
+	Publish(ctx context.Context, topicID string, msg *Message) (string, error)
+	// Subscribe delivers messages to handler until ctx is done. Handlers must Ack or Nack
+	// each message; on the redis backend this has to happen before the handler returns.
+	Subscribe(ctx context.Context, topicID string, handler func(context.Context, *Message)) error
+	Close() error
+}
+
+type Message struct {
+	ID              string
+	Data            []byte
+	Attributes      map[string]string
+	OrderingKey     string
+	DeliveryAttempt int
+	PublishTime     time.Time
+
+	ack  func()
+	nack func()
+	once sync.Once
+}
+
+func (m *Message) Ack() {
+	m.once.Do(func() {
+		if m.ack != nil {
+			m.ack()
+		}
+	})
+}
+
+func (m *Message) Nack() {
+	m.once.Do(func() {
+		if m.nack != nil {
+			m.nack()
+		}
+	})
+}
+
+type NatsConfig struct {
+	URL string `yaml:"url"`
+}
+
+// NewBroker connects to the transport named by c.Broker
+func NewBroker(ctx context.Context, c PubsubConfig) (Broker, error) {
+	switch c.Broker {
+	case GoogleBroker, "":
+		return newGoogleBroker(ctx, c)
+	case RedisBroker:
+		return newRedisBroker(ctx, c)
+	case NatsBroker:
+		return newNatsBroker(ctx, c)
+	case MemoryBroker:
+		return NewMemoryBroker(c), nil
+	}
+	return nil, fmt.Errorf("unknown broker %v", c.Broker)
+}
+
+func topicConfig(c PubsubConfig, topicID string) (Topic, error) {
+	topic, ok := c.Topics[topicID]
+	if !ok {
+		return Topic{}, fmt.Errorf("topic %v is not configured", topicID)
+	}
+	return topic, nil
+}
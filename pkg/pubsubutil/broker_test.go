@@ -0,0 +1,286 @@
+package pubsubutil
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labiraus/go-utils/pkg/redisutil"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = PubsubConfig{
+	Topics: map[string]Topic{
+		"events": {Name: "events", Subscription: "events-sub", Concurrency: 1, CreateTopic: true, CreateSubscription: true},
+	},
+}
+
+func TestMemoryBrokerDeliversAttributesAndOrderingKey(t *testing.T) {
+	broker := NewMemoryBroker(testConfig)
+	defer broker.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan *Message, 1)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		msg.Ack()
+		received <- msg
+	}))
+
+	_, err := broker.Publish(ctx, "events", &Message{
+		Data:        []byte("hello"),
+		Attributes:  map[string]string{"type": "greeting"},
+		OrderingKey: "user-1",
+	})
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", string(msg.Data))
+		assert.Equal(t, "greeting", msg.Attributes["type"])
+		assert.Equal(t, "user-1", msg.OrderingKey)
+		assert.Equal(t, 1, msg.DeliveryAttempt)
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestMemoryBrokerRedeliversNackedMessages(t *testing.T) {
+	broker := NewMemoryBroker(testConfig)
+	defer broker.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := make(chan int, 2)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		attempts <- msg.DeliveryAttempt
+		if msg.DeliveryAttempt == 1 {
+			msg.Nack()
+		} else {
+			msg.Ack()
+		}
+	}))
+
+	_, err := broker.Publish(ctx, "events", &Message{Data: []byte("retry me")})
+	assert.NoError(t, err)
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case attempt := <-attempts:
+			assert.Equal(t, expected, attempt)
+		case <-time.After(time.Second):
+			t.Fatalf("delivery attempt %v not received", expected)
+		}
+	}
+}
+
+func TestBrokerRejectsUnknownTopic(t *testing.T) {
+	broker := NewMemoryBroker(testConfig)
+	defer broker.Close()
+
+	_, err := broker.Publish(context.Background(), "missing", &Message{})
+	assert.Error(t, err)
+}
+
+func TestRedisBrokerRoundTrip(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := testConfig
+	config.Broker = RedisBroker
+	config.Redis = map[string]redisutil.RedisConfig{"redis": {Host: server.Host(), Port: server.Port()}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker, err := NewBroker(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	received := make(chan *Message, 1)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		msg.Ack()
+		received <- msg
+	}))
+
+	_, err = broker.Publish(ctx, "events", &Message{
+		Data:        []byte("hello"),
+		Attributes:  map[string]string{"type": "greeting"},
+		OrderingKey: "user-1",
+	})
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", string(msg.Data))
+		assert.Equal(t, map[string]string{"type": "greeting"}, msg.Attributes)
+		assert.Equal(t, "user-1", msg.OrderingKey)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestRedisBrokerOnlyDeadLettersWhenConfigured(t *testing.T) {
+	config := streamConfig(Topic{Name: "events", Subscription: "events-sub"})
+	assert.Equal(t, int64(math.MaxInt64), config.MaxDeliveries)
+
+	config = streamConfig(Topic{Name: "events", Subscription: "events-sub", DeadLetterTopic: "events-dead"})
+	assert.Equal(t, int64(0), config.MaxDeliveries, "redisutil's default applies")
+	assert.Equal(t, "events-dead", config.DeadLetter)
+
+	config = streamConfig(Topic{Name: "events", Subscription: "events-sub", MaxDeliveryAttempts: 3})
+	assert.Equal(t, int64(3), config.MaxDeliveries)
+}
+
+func startNats(t *testing.T) string {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns.ClientURL()
+}
+
+func TestNatsBrokerRoundTrip(t *testing.T) {
+	config := testConfig
+	config.Broker = NatsBroker
+	config.Nats = NatsConfig{URL: startNats(t)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker, err := NewBroker(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	received := make(chan *Message, 2)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		received <- msg
+		if msg.DeliveryAttempt == 1 {
+			msg.Nack()
+		} else {
+			msg.Ack()
+		}
+	}))
+
+	_, err = broker.Publish(ctx, "events", &Message{
+		Data:        []byte("hello"),
+		Attributes:  map[string]string{"type": "greeting"},
+		OrderingKey: "user-1",
+	})
+	assert.NoError(t, err)
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case msg := <-received:
+			assert.Equal(t, expected, msg.DeliveryAttempt)
+			assert.Equal(t, "hello", string(msg.Data))
+			assert.Equal(t, map[string]string{"type": "greeting"}, msg.Attributes)
+			assert.Equal(t, "user-1", msg.OrderingKey)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivery attempt %v not received", expected)
+		}
+	}
+}
+
+func TestMemoryBrokerDeadLettersAfterMaxDeliveryAttempts(t *testing.T) {
+	config := PubsubConfig{Topics: map[string]Topic{
+		"events": {Name: "events", Subscription: "events-sub", MaxDeliveryAttempts: 2, DeadLetterTopic: "events-dead"},
+		"dead":   {Name: "events-dead", Subscription: "events-dead-sub"},
+	}}
+	broker := NewMemoryBroker(config)
+	defer broker.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := make(chan int, 3)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		attempts <- msg.DeliveryAttempt
+		msg.Nack()
+	}))
+	dead := make(chan *Message, 1)
+	assert.NoError(t, broker.Subscribe(ctx, "dead", func(ctx context.Context, msg *Message) {
+		msg.Ack()
+		dead <- msg
+	}))
+
+	_, err := broker.Publish(ctx, "events", &Message{Data: []byte("poison")})
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-dead:
+		assert.Equal(t, "poison", string(msg.Data))
+	case <-time.After(time.Second):
+		t.Fatal("message not dead lettered")
+	}
+	assert.Len(t, attempts, 2)
+}
+
+func TestHandlerPanicIsNacked(t *testing.T) {
+	broker := NewMemoryBroker(testConfig)
+	defer broker.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := make(chan int, 2)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		attempts <- msg.DeliveryAttempt
+		if msg.DeliveryAttempt == 1 {
+			panic("poison")
+		}
+		msg.Ack()
+	}))
+
+	_, err := broker.Publish(ctx, "events", &Message{Data: []byte("hello")})
+	assert.NoError(t, err)
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case attempt := <-attempts:
+			assert.Equal(t, expected, attempt)
+		case <-time.After(time.Second):
+			t.Fatalf("delivery attempt %v not received", expected)
+		}
+	}
+}
+
+func TestBackplaneReachesEverySubscription(t *testing.T) {
+	broker := NewMemoryBroker(PubsubConfig{
+		Topics: map[string]Topic{
+			"replica-a": {Name: "websocket", Subscription: "websocket-a"},
+			"replica-b": {Name: "websocket", Subscription: "websocket-b"},
+		},
+	})
+	defer broker.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string, 2)
+	for _, topicID := range []string{"replica-a", "replica-b"} {
+		assert.NoError(t, NewBackplane(broker, topicID).Subscribe(ctx, func(data []byte) { received <- string(data) }))
+	}
+	assert.NoError(t, NewBackplane(broker, "replica-a").Publish(ctx, []byte("push")))
+	for range 2 {
+		select {
+		case data := <-received:
+			assert.Equal(t, "push", data)
+		case <-time.After(time.Second):
+			t.Fatal("push not relayed")
+		}
+	}
+}
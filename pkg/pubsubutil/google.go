@@ -0,0 +1,76 @@
+package pubsubutil
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const closeTimeout = 30 * time.Second
+
+type googleBroker struct {
+	client *Client
+}
+
+func newGoogleBroker(ctx context.Context, c PubsubConfig) (*googleBroker, error) {
+	client, err := NewClient(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return &googleBroker{client: client}, nil
+}
+
+func (b *googleBroker) Publish(ctx context.Context, topicID string, msg *Message) (string, error) {
+	topicConfig, err := topicConfig(b.client.config, topicID)
+	if err != nil {
+		return "", err
+	}
+	topic, err := b.client.topic(ctx, topicConfig)
+	if err != nil {
+		return "", err
+	}
+
+	result := topic.Publish(ctx, &pubsub.Message{
+		Data:        msg.Data,
+		Attributes:  msg.Attributes,
+		OrderingKey: msg.OrderingKey,
+	})
+	id, err := result.Get(ctx)
+	if err != nil && msg.OrderingKey != "" {
+		// a failed ordered publish pauses the key until it is resumed
+		topic.ResumePublish(msg.OrderingKey)
+	}
+	return id, err
+}
+
+func (b *googleBroker) Subscribe(ctx context.Context, topicID string, handler func(context.Context, *Message)) error {
+	topicConfig, err := topicConfig(b.client.config, topicID)
+	if err != nil {
+		return err
+	}
+
+	handler = instrument(topicConfig.Subscription, handler)
+	_, err = b.client.subscribe(ctx, topicConfig, func(ctx context.Context, m *pubsub.Message) {
+		msg := &Message{
+			ID:          m.ID,
+			Data:        m.Data,
+			Attributes:  m.Attributes,
+			OrderingKey: m.OrderingKey,
+			PublishTime: m.PublishTime,
+			ack:         m.Ack,
+			nack:        m.Nack,
+		}
+		if m.DeliveryAttempt != nil {
+			msg.DeliveryAttempt = *m.DeliveryAttempt
+		}
+		handler(ctx, msg)
+	})
+	return err
+}
+
+func (b *googleBroker) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return b.client.Close(ctx)
+}
@@ -0,0 +1,149 @@
+package pubsubutil
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type memoryBroker struct {
+	config PubsubConfig
+	mux    sync.Mutex
+	// subscriptions are keyed by topic name and then subscription name
+	subscriptions map[string]map[string]chan *Message
+	nextID        atomic.Int64
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewMemoryBroker returns an in-process Broker for unit tests. Subscriptions only receive
+// messages published after they were first subscribed, and nacked messages are redelivered
+// after MinRetryBackoff until MaxDeliveryAttempts moves them to the DeadLetterTopic.
+func NewMemoryBroker(c PubsubConfig) Broker {
+	return &memoryBroker{
+		config:        c,
+		subscriptions: make(map[string]map[string]chan *Message),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, topicID string, msg *Message) (string, error) {
+	topic, err := topicConfig(b.config, topicID)
+	if err != nil {
+		return "", err
+	}
+
+	id := strconv.FormatInt(b.nextID.Add(1), 10)
+	err = b.deliver(ctx, topic.Name, &Message{
+		ID:          id,
+		Data:        msg.Data,
+		Attributes:  msg.Attributes,
+		OrderingKey: msg.OrderingKey,
+		PublishTime: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// deliver hands a copy of msg to every subscription on the topic name
+func (b *memoryBroker) deliver(ctx context.Context, topicName string, msg *Message) error {
+	b.mux.Lock()
+	queues := make([]chan *Message, 0, len(b.subscriptions[topicName]))
+	for _, queue := range b.subscriptions[topicName] {
+		queues = append(queues, queue)
+	}
+	b.mux.Unlock()
+
+	for _, queue := range queues {
+		delivery := &Message{
+			ID:              msg.ID,
+			Data:            msg.Data,
+			Attributes:      maps.Clone(msg.Attributes),
+			OrderingKey:     msg.OrderingKey,
+			DeliveryAttempt: 1,
+			PublishTime:     msg.PublishTime,
+		}
+		select {
+		case queue <- delivery:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.closed:
+			return fmt.Errorf("broker closed")
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(ctx context.Context, topicID string, handler func(context.Context, *Message)) error {
+	topic, err := topicConfig(b.config, topicID)
+	if err != nil {
+		return err
+	}
+
+	b.mux.Lock()
+	if _, ok := b.subscriptions[topic.Name]; !ok {
+		b.subscriptions[topic.Name] = make(map[string]chan *Message)
+	}
+	queue, ok := b.subscriptions[topic.Name][topic.Subscription]
+	if !ok {
+		queue = make(chan *Message, 1000)
+		b.subscriptions[topic.Name][topic.Subscription] = queue
+	}
+	b.mux.Unlock()
+
+	handler = instrument(topic.Subscription, handler)
+	for range max(topic.Concurrency, 1) {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-b.closed:
+					return
+				case msg := <-queue:
+					msg.nack = func() { go b.redeliver(queue, topic, msg) }
+					handler(ctx, msg)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func (b *memoryBroker) redeliver(queue chan *Message, topic Topic, msg *Message) {
+	if topic.MaxDeliveryAttempts > 0 && msg.DeliveryAttempt >= topic.MaxDeliveryAttempts {
+		if topic.DeadLetterTopic != "" {
+			b.deliver(context.Background(), topic.DeadLetterTopic, msg)
+		}
+		return
+	}
+
+	select {
+	case <-time.After(topic.MinRetryBackoff):
+	case <-b.closed:
+		return
+	}
+	redelivery := &Message{
+		ID:              msg.ID,
+		Data:            msg.Data,
+		Attributes:      msg.Attributes,
+		OrderingKey:     msg.OrderingKey,
+		DeliveryAttempt: msg.DeliveryAttempt + 1,
+		PublishTime:     msg.PublishTime,
+	}
+	select {
+	case queue <- redelivery:
+	case <-b.closed:
+	}
+}
+
+func (b *memoryBroker) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
@@ -0,0 +1,82 @@
+package pubsubutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/labiraus/go-utils/pkg/prometheusutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	resultAck         = "ack"
+	resultNack        = "nack"
+	resultPanic       = "panic"
+	resultDecodeError = "decode_error"
+)
+
+var (
+	metricsOnce     sync.Once
+	messagesTotal   *prometheus.CounterVec
+	handlerDuration *prometheus.HistogramVec
+)
+
+func startMetrics() {
+	messagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: base.ServiceName + "_pubsub_messages_total",
+		Help: "The total number of received messages by outcome",
+	}, []string{"subscription", "result"})
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    base.ServiceName + "_pubsub_handler_duration_seconds",
+		Help:    "The duration of subscription handlers",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"subscription"})
+
+	prometheusutil.Register(messagesTotal, handlerDuration)
+}
+
+func countMessage(subscription, result string) {
+	metricsOnce.Do(startMetrics)
+	messagesTotal.WithLabelValues(subscription, result).Inc()
+}
+
+// observe is deferred around a handler call. It records the handler duration and turns a
+// panic into a nack so that one poison message can't take down the process.
+func observe(ctx context.Context, subscription string, nack func()) func() {
+	metricsOnce.Do(startMetrics)
+	start := time.Now()
+	return func() {
+		handlerDuration.WithLabelValues(subscription).Observe(time.Since(start).Seconds())
+		if r := recover(); r != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("handler for %v panicked: %v", subscription, r), "stack", string(debug.Stack()))
+			countMessage(subscription, resultPanic)
+			nack()
+		}
+	}
+}
+
+// instrument wraps Broker handlers with the same panic recovery and counts acks and nacks
+func instrument(subscription string, handler func(context.Context, *Message)) func(context.Context, *Message) {
+	return func(ctx context.Context, msg *Message) {
+		ack, nack := msg.ack, msg.nack
+		msg.ack = func() {
+			countMessage(subscription, resultAck)
+			if ack != nil {
+				ack()
+			}
+		}
+		msg.nack = func() {
+			countMessage(subscription, resultNack)
+			if nack != nil {
+				nack()
+			}
+		}
+		defer observe(ctx, subscription, msg.Nack)()
+		handler(ctx, msg)
+	}
+}
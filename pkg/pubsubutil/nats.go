@@ -0,0 +1,172 @@
+package pubsubutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const orderingKeyHeader = "Ordering-Key"
+
+var invalidStreamName = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// natsBroker uses a JetStream stream per topic and a durable consumer per subscription so
+// that messages can be acknowledged and redelivered like on Google Pub/Sub
+type natsBroker struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	config PubsubConfig
+}
+
+func newNatsBroker(ctx context.Context, c PubsubConfig) (*natsBroker, error) {
+	conn, err := nats.Connect(c.Nats.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats %v: %w", c.Nats.URL, err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+	return &natsBroker{conn: conn, js: js, config: c}, nil
+}
+
+func (b *natsBroker) Publish(ctx context.Context, topicID string, msg *Message) (string, error) {
+	topic, err := topicConfig(b.config, topicID)
+	if err != nil {
+		return "", err
+	}
+	if _, err = b.stream(ctx, topic); err != nil {
+		return "", err
+	}
+
+	natsMsg := nats.NewMsg(topic.Name)
+	natsMsg.Data = msg.Data
+	for k, v := range msg.Attributes {
+		natsMsg.Header.Set(k, v)
+	}
+	if msg.OrderingKey != "" {
+		natsMsg.Header.Set(orderingKeyHeader, msg.OrderingKey)
+	}
+
+	ack, err := b.js.PublishMsg(ctx, natsMsg)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(ack.Sequence), nil
+}
+
+func (b *natsBroker) Subscribe(ctx context.Context, topicID string, handler func(context.Context, *Message)) error {
+	topic, err := topicConfig(b.config, topicID)
+	if err != nil {
+		return err
+	}
+	stream, err := b.stream(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	// JetStream has no dead-letter topic; messages past MaxDeliver are dropped from the consumer
+	consumerConfig := jetstream.ConsumerConfig{
+		Durable:    invalidStreamName.ReplaceAllString(topic.Subscription, "_"),
+		AckPolicy:  jetstream.AckExplicitPolicy,
+		AckWait:    topic.AckDeadline,
+		MaxDeliver: topic.MaxDeliveryAttempts,
+	}
+	if topic.DeadLetterTopic != "" {
+		slog.Warn(fmt.Sprintf("dead letter topic %v is not supported by the nats broker", topic.DeadLetterTopic))
+	}
+	if topic.MaxOutstandingMessages > 0 {
+		consumerConfig.MaxAckPending = topic.MaxOutstandingMessages
+	}
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, consumerConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer %v: %w", topic.Subscription, err)
+	}
+
+	messages := make(chan jetstream.Msg)
+	consumeContext, err := consumer.Consume(func(m jetstream.Msg) {
+		select {
+		case messages <- m:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to consume %v: %w", topic.Subscription, err)
+	}
+	go func() {
+		<-ctx.Done()
+		consumeContext.Stop()
+	}()
+
+	handler = instrument(topic.Subscription, handler)
+	for range max(topic.Concurrency, 1) {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m := <-messages:
+					handler(ctx, fromNats(m, topic.MinRetryBackoff))
+				}
+			}
+		}()
+	}
+	slog.Info(fmt.Sprintf("subscribed to subject [%v] as consumer [%v]", topic.Name, consumerConfig.Durable))
+	return nil
+}
+
+func (b *natsBroker) Close() error {
+	return b.conn.Drain()
+}
+
+func (b *natsBroker) stream(ctx context.Context, topic Topic) (jetstream.Stream, error) {
+	name := invalidStreamName.ReplaceAllString(topic.Name, "_")
+	stream, err := b.js.Stream(ctx, name)
+	if err == nil {
+		return stream, nil
+	}
+	if !topic.CreateTopic {
+		return nil, fmt.Errorf("topic creation turned off %v and doesn't exist: %w", topic.Name, err)
+	}
+	stream, err = b.js.CreateStream(ctx, jetstream.StreamConfig{Name: name, Subjects: []string{topic.Name}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stream %v: %w", name, err)
+	}
+	return stream, nil
+}
+
+func fromNats(m jetstream.Msg, retryBackoff time.Duration) *Message {
+	msg := &Message{
+		Data:       m.Data(),
+		Attributes: make(map[string]string, len(m.Headers())),
+		ack: func() {
+			if err := m.Ack(); err != nil {
+				slog.Error("failed to ack nats message", "error", err)
+			}
+		},
+		nack: func() {
+			if err := m.NakWithDelay(retryBackoff); err != nil {
+				slog.Error("failed to nack nats message", "error", err)
+			}
+		},
+	}
+	for k := range m.Headers() {
+		if k == orderingKeyHeader {
+			msg.OrderingKey = m.Headers().Get(k)
+		} else {
+			msg.Attributes[k] = m.Headers().Get(k)
+		}
+	}
+	if meta, err := m.Metadata(); err == nil {
+		msg.ID = fmt.Sprint(meta.Sequence.Stream)
+		msg.DeliveryAttempt = int(meta.NumDelivered)
+		msg.PublishTime = meta.Timestamp
+	}
+	return msg
+}
@@ -0,0 +1,154 @@
+package pubsubutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventIDAttribute carries the outbox event ID so that consumers can drop the duplicates
+// that at-least-once relaying produces after a crash
+const EventIDAttribute = "event-id"
+
+type OutboxEvent struct {
+	ID          string            `json:"id"`
+	TopicID     string            `json:"topicId"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// OutboxStore is the relay's view of an outbox. Events are recorded through the
+// store specific API so that they commit together with the state change that caused them.
+type OutboxStore interface {
+	// Pending returns up to limit unpublished events, oldest first
+	Pending(ctx context.Context, limit int) ([]OutboxEvent, error)
+	MarkPublished(ctx context.Context, ids ...string) error
+}
+
+type RelayConfig struct {
+	PollInterval time.Duration `yaml:"pollInterval"`
+	BatchSize    int           `yaml:"batchSize"`
+	MaxBackoff   time.Duration `yaml:"maxBackoff"`
+}
+
+// Relay publishes outbox events through a Broker. Only run one relay per outbox, for
+// example behind a redisutil lock; concurrent relays would publish every event twice.
+type Relay struct {
+	store  OutboxStore
+	broker Broker
+	config RelayConfig
+	notify chan struct{}
+}
+
+func NewRelay(store OutboxStore, broker Broker, config RelayConfig) *Relay {
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = time.Minute
+	}
+	return &Relay{
+		store:  store,
+		broker: broker,
+		config: config,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay without waiting for the next poll, typically after a commit
+func (r *Relay) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) Start(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		delay := r.config.PollInterval
+		for ctx.Err() == nil {
+			published, err := r.relay(ctx)
+			switch {
+			case err != nil:
+				slog.ErrorContext(ctx, fmt.Sprintf("outbox relay failed, retrying in %v: %v", delay, err))
+			case published == r.config.BatchSize:
+				// there's likely more waiting so don't sleep
+				delay = r.config.PollInterval
+				continue
+			default:
+				delay = r.config.PollInterval
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.notify:
+			case <-time.After(delay):
+			}
+			if err != nil {
+				delay = min(delay*2, r.config.MaxBackoff)
+			}
+		}
+	}()
+	return done
+}
+
+// relay publishes one batch in order, stopping at the first failure so that a later event
+// is never published ahead of an earlier one
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	events, err := r.store.Pending(ctx, r.config.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("reading outbox: %w", err)
+	}
+
+	published := make([]string, 0, len(events))
+	var publishErr error
+	for _, event := range events {
+		attributes := maps.Clone(event.Attributes)
+		if attributes == nil {
+			attributes = make(map[string]string, 1)
+		}
+		attributes[EventIDAttribute] = event.ID
+
+		_, publishErr = r.broker.Publish(ctx, event.TopicID, &Message{
+			Data:        event.Data,
+			Attributes:  attributes,
+			OrderingKey: event.OrderingKey,
+		})
+		if publishErr != nil {
+			publishErr = fmt.Errorf("publishing event %v to %v: %w", event.ID, event.TopicID, publishErr)
+			break
+		}
+		published = append(published, event.ID)
+	}
+
+	if len(published) > 0 {
+		if err := r.store.MarkPublished(ctx, published...); err != nil {
+			return 0, fmt.Errorf("marking events published: %w", err)
+		}
+	}
+	return len(published), publishErr
+}
+
+func prepareEvents(events []OutboxEvent) {
+	now := time.Now()
+	for i := range events {
+		if events[i].ID == "" {
+			events[i].ID = uuid.NewString()
+		}
+		if events[i].CreatedAt.IsZero() {
+			events[i].CreatedAt = now
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package pubsubutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+type fileSnapshot[S any] struct {
+	State  S             `json:"state"`
+	Outbox []OutboxEvent `json:"outbox"`
+}
+
+// FileOutbox keeps pending events in the same JSON file as a state snapshot. Every write
+// goes through a temporary file and a rename, so the state and its events can't diverge.
+type FileOutbox[S any] struct {
+	path     string
+	mux      sync.Mutex
+	snapshot fileSnapshot[S]
+}
+
+// OpenFileOutbox loads the snapshot at path, starting empty if the file doesn't exist
+func OpenFileOutbox[S any](path string) (*FileOutbox[S], error) {
+	o := &FileOutbox[S]{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read outbox %v: %w", path, err)
+	}
+	if err = json.Unmarshal(data, &o.snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode outbox %v: %w", path, err)
+	}
+	return o, nil
+}
+
+func (o *FileOutbox[S]) State() S {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.snapshot.State
+}
+
+// Commit durably stores state together with events. The state is encoded again whenever
+// published events are removed, so callers shouldn't mutate it outside of Commit.
+func (o *FileOutbox[S]) Commit(ctx context.Context, state S, events ...OutboxEvent) error {
+	prepareEvents(events)
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	snapshot := fileSnapshot[S]{
+		State:  state,
+		Outbox: append(slices.Clone(o.snapshot.Outbox), events...),
+	}
+	if err := o.write(snapshot); err != nil {
+		return err
+	}
+	o.snapshot = snapshot
+	return nil
+}
+
+func (o *FileOutbox[S]) Pending(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return slices.Clone(o.snapshot.Outbox[:min(limit, len(o.snapshot.Outbox))]), nil
+}
+
+func (o *FileOutbox[S]) MarkPublished(ctx context.Context, ids ...string) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	snapshot := fileSnapshot[S]{
+		State: o.snapshot.State,
+		Outbox: slices.DeleteFunc(slices.Clone(o.snapshot.Outbox), func(event OutboxEvent) bool {
+			return slices.Contains(ids, event.ID)
+		}),
+	}
+	if err := o.write(snapshot); err != nil {
+		return err
+	}
+	o.snapshot = snapshot
+	return nil
+}
+
+func (o *FileOutbox[S]) write(snapshot fileSnapshot[S]) error {
+	tmp := o.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	if err = json.NewEncoder(file).Encode(snapshot); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to encode outbox: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync outbox: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox: %w", err)
+	}
+	return os.Rename(tmp, o.path)
+}
@@ -0,0 +1,138 @@
+package pubsubutil
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	PostgresDialect = "postgres"
+	MySQLDialect    = "mysql"
+	SQLiteDialect   = "sqlite"
+)
+
+// SQLOutbox stores events in a table so that they can be inserted in the same transaction
+// as the rows they describe
+type SQLOutbox struct {
+	db      *sql.DB
+	table   string
+	dialect string
+}
+
+func NewSQLOutbox(db *sql.DB, table, dialect string) (*SQLOutbox, error) {
+	switch dialect {
+	case PostgresDialect, MySQLDialect, SQLiteDialect:
+	default:
+		return nil, fmt.Errorf("unsupported sql dialect %v", dialect)
+	}
+	if table == "" {
+		table = "outbox"
+	}
+	return &SQLOutbox{db: db, table: table, dialect: dialect}, nil
+}
+
+// CreateTable creates the outbox table. Events are relayed in the order of its seq column,
+// as ids are random and events added together share a created_at.
+func (o *SQLOutbox) CreateTable(ctx context.Context) error {
+	blob, seq := "BLOB", "INTEGER PRIMARY KEY AUTOINCREMENT"
+	switch o.dialect {
+	case PostgresDialect:
+		blob, seq = "BYTEA", "BIGSERIAL PRIMARY KEY"
+	case MySQLDialect:
+		seq = "BIGINT AUTO_INCREMENT PRIMARY KEY"
+	}
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	seq %s,
+	id VARCHAR(64) NOT NULL UNIQUE,
+	topic_id VARCHAR(255) NOT NULL,
+	data %s NOT NULL,
+	attributes TEXT NOT NULL,
+	ordering_key VARCHAR(255) NOT NULL,
+	created_at BIGINT NOT NULL,
+	published_at BIGINT
+)`, o.table, seq, blob))
+	return err
+}
+
+// Add inserts events within tx. They become visible to the relay when tx commits.
+func (o *SQLOutbox) Add(ctx context.Context, tx *sql.Tx, events ...OutboxEvent) error {
+	prepareEvents(events)
+	query := fmt.Sprintf("INSERT INTO %s (id, topic_id, data, attributes, ordering_key, created_at) VALUES (%s)",
+		o.table, o.placeholders(1, 6))
+	for _, event := range events {
+		attributes, err := json.Marshal(event.Attributes)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, event.ID, event.TopicID, event.Data, string(attributes), event.OrderingKey, event.CreatedAt.UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to insert event %v: %w", event.ID, err)
+		}
+	}
+	return nil
+}
+
+func (o *SQLOutbox) Pending(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	query := fmt.Sprintf("SELECT id, topic_id, data, attributes, ordering_key, created_at FROM %s WHERE published_at IS NULL ORDER BY seq LIMIT %s",
+		o.table, o.placeholders(1, 1))
+	rows, err := o.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var event OutboxEvent
+		var attributes string
+		var createdAt int64
+		if err = rows.Scan(&event.ID, &event.TopicID, &event.Data, &attributes, &event.OrderingKey, &createdAt); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(attributes), &event.Attributes); err != nil {
+			return nil, fmt.Errorf("failed to decode attributes of event %v: %w", event.ID, err)
+		}
+		event.CreatedAt = time.Unix(0, createdAt)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (o *SQLOutbox) MarkPublished(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query := fmt.Sprintf("UPDATE %s SET published_at = %s WHERE id IN (%s)",
+		o.table, o.placeholders(1, 1), o.placeholders(2, len(ids)))
+	args := make([]any, 0, len(ids)+1)
+	args = append(args, time.Now().UnixNano())
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := o.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Purge deletes events that were published before olderThan ago
+func (o *SQLOutbox) Purge(ctx context.Context, olderThan time.Duration) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE published_at < %s", o.table, o.placeholders(1, 1))
+	_, err := o.db.ExecContext(ctx, query, time.Now().Add(-olderThan).UnixNano())
+	return err
+}
+
+// placeholders returns count comma separated bind parameters starting at position first
+func (o *SQLOutbox) placeholders(first, count int) string {
+	params := make([]string, count)
+	for i := range params {
+		if o.dialect == PostgresDialect {
+			params[i] = fmt.Sprintf("$%d", first+i)
+		} else {
+			params[i] = "?"
+		}
+	}
+	return strings.Join(params, ", ")
+}
@@ -0,0 +1,197 @@
+package pubsubutil
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+)
+
+func TestFileOutboxSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	outbox, err := OpenFileOutbox[map[string]string](path)
+	assert.NoError(t, err)
+
+	err = outbox.Commit(context.Background(), map[string]string{"a": "1"}, OutboxEvent{TopicID: "events", Data: []byte("a set")})
+	assert.NoError(t, err)
+
+	reopened, err := OpenFileOutbox[map[string]string](path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1"}, reopened.State())
+
+	pending, err := reopened.Pending(context.Background(), 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.NotEmpty(t, pending[0].ID)
+		assert.Equal(t, "a set", string(pending[0].Data))
+	}
+
+	assert.NoError(t, reopened.MarkPublished(context.Background(), pending[0].ID))
+	pending, err = reopened.Pending(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Equal(t, map[string]string{"a": "1"}, reopened.State())
+}
+
+func TestRelayPublishesWithEventID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := NewMemoryBroker(testConfig)
+	defer broker.Close()
+
+	received := make(chan *Message, 1)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		msg.Ack()
+		received <- msg
+	}))
+
+	outbox, err := OpenFileOutbox[int](filepath.Join(t.TempDir(), "data.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, outbox.Commit(ctx, 1, OutboxEvent{ID: "event-1", TopicID: "events", Data: []byte("hello")}))
+
+	relay := NewRelay(outbox, broker, RelayConfig{PollInterval: 10 * time.Millisecond})
+	relay.Start(ctx)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", string(msg.Data))
+		assert.Equal(t, "event-1", msg.Attributes[EventIDAttribute])
+	case <-time.After(time.Second):
+		t.Fatal("event not relayed")
+	}
+	assert.Eventually(t, func() bool {
+		pending, err := outbox.Pending(ctx, 10)
+		return err == nil && len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+type flakyBroker struct {
+	Broker
+	failures atomic.Int32
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, topicID string, msg *Message) (string, error) {
+	if b.failures.Add(-1) >= 0 {
+		return "", errors.New("unavailable")
+	}
+	return b.Broker.Publish(ctx, topicID, msg)
+}
+
+func TestRelayRetriesInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := &flakyBroker{Broker: NewMemoryBroker(testConfig)}
+	broker.failures.Store(2)
+	defer broker.Close()
+
+	received := make(chan string, 2)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *Message) {
+		msg.Ack()
+		received <- string(msg.Data)
+	}))
+
+	outbox, err := OpenFileOutbox[int](filepath.Join(t.TempDir(), "data.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, outbox.Commit(ctx, 1,
+		OutboxEvent{TopicID: "events", Data: []byte("first")},
+		OutboxEvent{TopicID: "events", Data: []byte("second")},
+	))
+
+	NewRelay(outbox, broker, RelayConfig{PollInterval: 10 * time.Millisecond}).Start(ctx)
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case data := <-received:
+			assert.Equal(t, expected, data)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%v not relayed", expected)
+		}
+	}
+}
+
+func openSQLOutbox(t *testing.T) (*SQLOutbox, *sql.DB) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "outbox.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	outbox, err := NewSQLOutbox(db, "", SQLiteDialect)
+	assert.NoError(t, err)
+	assert.NoError(t, outbox.CreateTable(context.Background()))
+	return outbox, db
+}
+
+func addEvents(t *testing.T, db *sql.DB, outbox *SQLOutbox, commit bool, events ...OutboxEvent) {
+	tx, err := db.BeginTx(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, outbox.Add(context.Background(), tx, events...))
+	if commit {
+		assert.NoError(t, tx.Commit())
+	} else {
+		assert.NoError(t, tx.Rollback())
+	}
+}
+
+func TestSQLOutboxPendingKeepsInsertOrder(t *testing.T) {
+	ctx := context.Background()
+	outbox, db := openSQLOutbox(t)
+
+	// events added together share a created_at and have random ids
+	var batch []OutboxEvent
+	for _, data := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		batch = append(batch, OutboxEvent{TopicID: "events", Data: []byte(data)})
+	}
+	addEvents(t, db, outbox, true, batch...)
+	addEvents(t, db, outbox, false, OutboxEvent{TopicID: "events", Data: []byte("rolled back")})
+	addEvents(t, db, outbox, true, OutboxEvent{
+		ID:          "event-9",
+		TopicID:     "events",
+		Data:        []byte("i"),
+		Attributes:  map[string]string{"kind": "last"},
+		OrderingKey: "key",
+	})
+
+	pending, err := outbox.Pending(ctx, 10)
+	assert.NoError(t, err)
+	var data []string
+	for _, event := range pending {
+		data = append(data, string(event.Data))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"}, data)
+	last := pending[len(pending)-1]
+	assert.Equal(t, "event-9", last.ID)
+	assert.Equal(t, map[string]string{"kind": "last"}, last.Attributes)
+	assert.Equal(t, "key", last.OrderingKey)
+	assert.False(t, last.CreatedAt.IsZero())
+
+	pending, err = outbox.Pending(ctx, 2)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+}
+
+func TestSQLOutboxMarkPublished(t *testing.T) {
+	ctx := context.Background()
+	outbox, db := openSQLOutbox(t)
+	addEvents(t, db, outbox, true,
+		OutboxEvent{ID: "event-1", TopicID: "events", Data: []byte("first")},
+		OutboxEvent{ID: "event-2", TopicID: "events", Data: []byte("second")},
+		OutboxEvent{ID: "event-3", TopicID: "events", Data: []byte("third")},
+	)
+
+	assert.NoError(t, outbox.MarkPublished(ctx))
+	assert.NoError(t, outbox.MarkPublished(ctx, "event-1", "event-3"))
+	pending, err := outbox.Pending(ctx, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "event-2", pending[0].ID)
+	}
+
+	assert.NoError(t, outbox.Purge(ctx, -time.Minute))
+	var count int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM outbox").Scan(&count))
+	assert.Equal(t, 1, count)
+}
@@ -2,30 +2,55 @@ package pubsubutil
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/labiraus/go-utils/pkg/redisutil"
 	"google.golang.org/api/option"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-	client      *pubsub.Client
-	topics      = make(map[string]*pubsub.Topic)
-	UseProtobuf = false
-	config      PubsubConfig
-	rwMux       = sync.RWMutex{}
+	UseProtobuf   = false
+	defaultClient *Client
 )
 
+// ErrNotStarted is returned by the package level functions before Start
+var ErrNotStarted = errors.New("pubsubutil not started")
+
+func started() (*Client, error) {
+	if defaultClient == nil {
+		return nil, ErrNotStarted
+	}
+	return defaultClient, nil
+}
+
+// Client owns a Pub/Sub connection together with the topics and subscriptions opened on it
+type Client struct {
+	client        *pubsub.Client
+	config        PubsubConfig
+	rwMux         sync.RWMutex
+	topics        map[string]*pubsub.Topic
+	subMux        sync.Mutex
+	subscriptions []*Subscription
+}
+
 type PubsubConfig struct {
 	Host      string           `yaml:"host"`
 	Port      string           `yaml:"port"`
 	Projectid string           `yaml:"projectid"`
 	Emulator  bool             `yaml:"emulator"`
 	Topics    map[string]Topic `yaml:"topics"`
+	// Broker selects the NewBroker transport: google (default), redis, nats or memory
+	Broker string                           `yaml:"broker"`
+	Redis  map[string]redisutil.RedisConfig `yaml:"redis"`
+	Nats   NatsConfig                       `yaml:"nats"`
 }
 
 type Topic struct {
@@ -35,58 +60,234 @@ type Topic struct {
 	CreateSubscription     bool   `yaml:"createSubscription"`
 	Concurrency            int    `yaml:"concurrency"`
 	MaxOutstandingMessages int    `yaml:"maxOutstandingMessages"`
+	MessageOrdering        bool   `yaml:"messageOrdering"`
+	// Encoding is json or protobuf for the typed Publish and Subscribe, defaulting to UseProtobuf
+	Encoding       string        `yaml:"encoding"`
+	BatchCount     int           `yaml:"batchCount"`
+	BatchBytes     int           `yaml:"batchBytes"`
+	BatchDelay     time.Duration `yaml:"batchDelay"`
+	PublishTimeout time.Duration `yaml:"publishTimeout"`
+	// DeadLetterTopic receives messages after MaxDeliveryAttempts. On Google Pub/Sub the
+	// service account needs publish rights on it and subscribe rights on the subscription.
+	// Without either, messages are retried forever. A DeadLetterTopic without
+	// MaxDeliveryAttempts dead-letters after 5 deliveries on Google Pub/Sub and redis. When
+	// MaxDeliveryAttempts is set without a DeadLetterTopic the memory broker drops messages,
+	// nats stops delivering them and redis moves them to "<name>:dead".
+	DeadLetterTopic     string        `yaml:"deadLetterTopic"`
+	MaxDeliveryAttempts int           `yaml:"maxDeliveryAttempts"`
+	MinRetryBackoff     time.Duration `yaml:"minRetryBackoff"`
+	MaxRetryBackoff     time.Duration `yaml:"maxRetryBackoff"`
+	AckDeadline         time.Duration `yaml:"ackDeadline"`
+	// Filter and ExactlyOnce are only supported by Google Pub/Sub
+	Filter      string `yaml:"filter"`
+	ExactlyOnce bool   `yaml:"exactlyOnce"`
+}
+
+// Start creates the client used by the package level Subscribe, Publish and GetTopic. The
+// caller owns it and should Close it on shutdown to drain subscriptions and flush publishes.
+func Start(ctx context.Context, c PubsubConfig) (*Client, error) {
+	slog.Info("initializing pubsub", "config", c)
+	client, err := NewClient(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	defaultClient = client
+	return client, nil
+}
+
+func NewClient(ctx context.Context, c PubsubConfig) (*Client, error) {
+	client, err := dial(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client: client, config: c, topics: make(map[string]*pubsub.Topic)}, nil
 }
 
-func Start(ctx context.Context, c PubsubConfig) error {
-	config = c
-	var err error
-	slog.Info("initializing pubsub", "config", config)
+// Close drains every subscription, waiting for in-flight handlers until ctx is done, then
+// flushes pending publishes and closes the connection
+func (c *Client) Close(ctx context.Context) error {
+	c.subMux.Lock()
+	subscriptions := c.subscriptions
+	c.subscriptions = nil
+	c.subMux.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(subscriptions))
+	for i, sub := range subscriptions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = sub.Drain(ctx)
+		}()
+	}
+	wg.Wait()
+
+	c.rwMux.Lock()
+	for _, topic := range c.topics {
+		topic.Stop()
+	}
+	c.rwMux.Unlock()
+
+	errs = append(errs, c.client.Close())
+	slog.Info("pubsub client closed")
+	return errors.Join(errs...)
+}
+
+func dial(ctx context.Context, config PubsubConfig) (*pubsub.Client, error) {
 	opts := []option.ClientOption{
 		option.WithGRPCConnectionPool(2),
 	}
 	if config.Emulator {
-		os.Setenv("PUBSUB_EMULATOR_HOST", "pubsub:"+config.Port)
+		// the client library switches to an insecure connection when this is set
+		address := net.JoinHostPort(config.Host, config.Port)
+		os.Setenv("PUBSUB_EMULATOR_HOST", address)
 		opts = append(opts, option.WithoutAuthentication())
-		opts = append(opts, option.WithEndpoint(config.Host+":"+config.Port))
+		opts = append(opts, option.WithEndpoint(address))
+	}
+	client, err := pubsub.NewClient(ctx, config.Projectid, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewClient: %w", err)
+	}
+	return client, nil
+}
+
+// SubscribeRaw hands undecoded messages to handler, which is responsible for acking them
+func SubscribeRaw(ctx context.Context, topicID string, handler func(context.Context, *pubsub.Message)) (*Subscription, error) {
+	client, err := started()
+	if err != nil {
+		return nil, err
 	}
-	client, err = pubsub.NewClient(ctx, config.Projectid, opts...)
+	return client.SubscribeRaw(ctx, topicID, handler)
+}
+
+func GetTopic(ctx context.Context, topicID string) (*pubsub.Topic, error) {
+	client, err := started()
+	if err != nil {
+		return nil, err
+	}
+	return client.Topic(ctx, topicID)
+}
+
+func (c *Client) SubscribeRaw(ctx context.Context, topicID string, handler func(context.Context, *pubsub.Message)) (*Subscription, error) {
+	topicConfig := c.config.Topics[topicID]
+	return c.subscribe(ctx, topicConfig, func(ctx context.Context, msg *pubsub.Message) {
+		defer observe(ctx, topicConfig.Subscription, msg.Nack)()
+		handler(ctx, msg)
+	})
+}
+
+func (c *Client) subscribe(ctx context.Context, topicConfig Topic, handler func(context.Context, *pubsub.Message)) (*Subscription, error) {
+	sub, err := ensureSubscription(ctx, c.client, topicConfig)
 	if err != nil {
-		return fmt.Errorf("pubsub.NewClient: %w", err)
+		return nil, err
 	}
-	go func() {
-		defer client.Close()
-		<-ctx.Done()
-		slog.Info("pubsub client closed")
-	}()
 
-	return nil
+	subscription := newSubscription(ctx, sub, handler)
+	c.subMux.Lock()
+	c.subscriptions = append(c.subscriptions, subscription)
+	c.subMux.Unlock()
+	slog.Info(fmt.Sprintf("subscribed to topic [%v] as subscription [%v]", topicConfig.Name, topicConfig.Subscription))
+
+	return subscription, nil
 }
 
-func Subscribe(ctx context.Context, topicID string, handler func(context.Context, *pubsub.Message)) error {
-	topicConfig := config.Topics[topicID]
+func (c *Client) Topic(ctx context.Context, topicID string) (*pubsub.Topic, error) {
+	return c.topic(ctx, c.config.Topics[topicID])
+}
 
+func (c *Client) topic(ctx context.Context, topicConfig Topic) (*pubsub.Topic, error) {
+	c.rwMux.RLock()
+	topic, ok := c.topics[topicConfig.Name]
+	c.rwMux.RUnlock()
+	if ok {
+		return topic, nil
+	}
+
+	c.rwMux.Lock()
+	defer c.rwMux.Unlock()
+	if topic, ok = c.topics[topicConfig.Name]; ok {
+		return topic, nil
+	}
+	topic, err := ensureTopic(ctx, c.client, topicConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.topics[topicConfig.Name] = topic
+	return topic, nil
+}
+
+func ensureTopic(ctx context.Context, client *pubsub.Client, topicConfig Topic) (*pubsub.Topic, error) {
 	topic := client.Topic(topicConfig.Name)
 	if exists, err := topic.Exists(ctx); err != nil {
-		return fmt.Errorf("failed to check if topic %s exists: %v", topicConfig.Name, err)
+		return nil, fmt.Errorf("failed to check if topic %s exists: %v", topicConfig.Name, err)
 	} else if !exists && topicConfig.CreateTopic {
 		topic, err = client.CreateTopic(ctx, topicConfig.Name)
 		if err != nil {
-			return fmt.Errorf("failed to create topic: %v", err)
+			return nil, fmt.Errorf("failed to create topic: %v", err)
 		}
 	} else if !exists {
-		return fmt.Errorf("topic creation turned off %v and doesn't exist: %v", topicConfig.Name, err)
+		return nil, fmt.Errorf("topic creation turned off %v and doesn't exist", topicConfig.Name)
+	}
+	topic.EnableMessageOrdering = topicConfig.MessageOrdering
+	if topicConfig.BatchCount > 0 {
+		topic.PublishSettings.CountThreshold = topicConfig.BatchCount
+	}
+	if topicConfig.BatchBytes > 0 {
+		topic.PublishSettings.ByteThreshold = topicConfig.BatchBytes
+	}
+	if topicConfig.BatchDelay > 0 {
+		topic.PublishSettings.DelayThreshold = topicConfig.BatchDelay
+	}
+	if topicConfig.PublishTimeout > 0 {
+		topic.PublishSettings.Timeout = topicConfig.PublishTimeout
+	}
+	return topic, nil
+}
+
+func ensureSubscription(ctx context.Context, client *pubsub.Client, topicConfig Topic) (*pubsub.Subscription, error) {
+	topic, err := ensureTopic(ctx, client, topicConfig)
+	if err != nil {
+		return nil, err
 	}
 
 	sub := client.Subscription(topicConfig.Subscription)
 	if exists, err := sub.Exists(ctx); err != nil {
-		return fmt.Errorf("failed to check if subscription %s exists: %v", topicConfig.Subscription, err)
+		return nil, fmt.Errorf("failed to check if subscription %s exists: %v", topicConfig.Subscription, err)
 	} else if !exists && topicConfig.CreateSubscription {
-		sub, err = client.CreateSubscription(context.Background(), topicConfig.Subscription, pubsub.SubscriptionConfig{Topic: topic})
+		deadLetterPolicy, err := deadLetterPolicy(ctx, client, topicConfig)
+		if err != nil {
+			return nil, err
+		}
+		sub, err = client.CreateSubscription(context.Background(), topicConfig.Subscription, pubsub.SubscriptionConfig{
+			Topic:                     topic,
+			EnableMessageOrdering:     topicConfig.MessageOrdering,
+			AckDeadline:               topicConfig.AckDeadline,
+			DeadLetterPolicy:          deadLetterPolicy,
+			RetryPolicy:               retryPolicy(topicConfig),
+			Filter:                    topicConfig.Filter,
+			EnableExactlyOnceDelivery: topicConfig.ExactlyOnce,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe to topic %v as subscription %v: %v", topicConfig.Name, topicConfig.Subscription, err)
+		}
+	} else if exists && topicConfig.CreateSubscription {
+		// filters can't be changed after creation but the delivery policies can
+		deadLetterPolicy, err := deadLetterPolicy(ctx, client, topicConfig)
 		if err != nil {
-			return fmt.Errorf("failed to subscribe to topic %v as subscription %v: %v", topicConfig.Name, topicConfig.Subscription, err)
+			return nil, err
+		}
+		current, err := sub.Config(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read subscription %v: %v", topicConfig.Subscription, err)
+		}
+		// only updating what changed lets subscribers without update rights start
+		if update, ok := subscriptionUpdate(current, topicConfig, deadLetterPolicy); ok {
+			if _, err = sub.Update(ctx, update); err != nil {
+				return nil, fmt.Errorf("failed to update subscription %v: %v", topicConfig.Subscription, err)
+			}
 		}
 	} else if !exists {
-		return fmt.Errorf("subscription creation turned off and %v on topic %v doesn't exist: %v", topicConfig.Subscription, topicConfig.Name, err)
+		return nil, fmt.Errorf("subscription creation turned off and %v on topic %v doesn't exist", topicConfig.Subscription, topicConfig.Name)
 	}
 
 	if topicConfig.Concurrency > 1 {
@@ -94,50 +295,71 @@ func Subscribe(ctx context.Context, topicID string, handler func(context.Context
 		sub.ReceiveSettings.NumGoroutines = topicConfig.Concurrency
 		sub.ReceiveSettings.MaxOutstandingMessages = topicConfig.MaxOutstandingMessages
 	}
+	return sub, nil
+}
 
-	go func() {
-		err := sub.Receive(ctx, handler)
-		if err != nil {
-			panic(fmt.Errorf("error recieving subscription: %v", err))
+// subscriptionUpdate holds the fields that differ between current and topicConfig, and
+// reports whether there are any. Settings left unset in topicConfig are never changed, so
+// ExactlyOnce can't switch off exactly once delivery that was enabled elsewhere.
+func subscriptionUpdate(current pubsub.SubscriptionConfig, topicConfig Topic, deadLetterPolicy *pubsub.DeadLetterPolicy) (pubsub.SubscriptionConfigToUpdate, bool) {
+	var update pubsub.SubscriptionConfigToUpdate
+	changed := false
+	if topicConfig.AckDeadline > 0 && topicConfig.AckDeadline != current.AckDeadline {
+		update.AckDeadline = topicConfig.AckDeadline
+		changed = true
+	}
+	if deadLetterPolicy != nil {
+		// Pub/Sub defaults MaxDeliveryAttempts to 5
+		wanted := *deadLetterPolicy
+		if wanted.MaxDeliveryAttempts == 0 {
+			wanted.MaxDeliveryAttempts = 5
 		}
-	}()
-	slog.Info(fmt.Sprintf("subscribed to topic [%v] as subscription [%v]", topicConfig.Name, topicConfig.Subscription))
-
-	return nil
+		if current.DeadLetterPolicy == nil || *current.DeadLetterPolicy != wanted {
+			update.DeadLetterPolicy = deadLetterPolicy
+			changed = true
+		}
+	}
+	if policy := retryPolicy(topicConfig); policy != nil {
+		if current.RetryPolicy == nil ||
+			policy.MinimumBackoff != nil && policy.MinimumBackoff != current.RetryPolicy.MinimumBackoff ||
+			policy.MaximumBackoff != nil && policy.MaximumBackoff != current.RetryPolicy.MaximumBackoff {
+			update.RetryPolicy = policy
+			changed = true
+		}
+	}
+	if topicConfig.ExactlyOnce && !current.EnableExactlyOnceDelivery {
+		update.EnableExactlyOnceDelivery = true
+		changed = true
+	}
+	return update, changed
 }
 
-func GetTopic(ctx context.Context, topicID string) (*pubsub.Topic, error) {
-	topicConfig := config.Topics[topicID]
-	var topic *pubsub.Topic
-	ok := false
-	func() {
-		rwMux.RLock()
-		defer rwMux.RUnlock()
-		topic, ok = topics[topicConfig.Name]
-	}()
-	if ok {
-		return topic, nil
+func deadLetterPolicy(ctx context.Context, client *pubsub.Client, topicConfig Topic) (*pubsub.DeadLetterPolicy, error) {
+	if topicConfig.DeadLetterTopic == "" {
+		return nil, nil
+	}
+	deadLetter, err := ensureTopic(ctx, client, Topic{Name: topicConfig.DeadLetterTopic, CreateTopic: topicConfig.CreateTopic})
+	if err != nil {
+		return nil, fmt.Errorf("dead letter topic: %w", err)
 	}
+	return &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     deadLetter.String(),
+		MaxDeliveryAttempts: topicConfig.MaxDeliveryAttempts,
+	}, nil
+}
 
-	err := func() error {
-		rwMux.Lock()
-		defer rwMux.Unlock()
-		topic = client.Topic(topicConfig.Name)
-		if exists, err := topic.Exists(ctx); err != nil {
-			return fmt.Errorf("failed to check if topic %s exists: %v", topicConfig.Name, err)
-		} else if !exists && topicConfig.CreateTopic {
-			topic, err = client.CreateTopic(ctx, topicConfig.Name)
-			if err != nil {
-				return fmt.Errorf("failed to create topic: %v", err)
-			}
-		} else if !exists {
-			return fmt.Errorf("topic does not exist and cannot be created")
-		}
-		topics[topicConfig.Name] = topic
+func retryPolicy(topicConfig Topic) *pubsub.RetryPolicy {
+	if topicConfig.MinRetryBackoff <= 0 && topicConfig.MaxRetryBackoff <= 0 {
 		return nil
-	}()
-
-	return topic, err
+	}
+	policy := &pubsub.RetryPolicy{}
+	if topicConfig.MinRetryBackoff > 0 {
+		policy.MinimumBackoff = topicConfig.MinRetryBackoff
+	}
+	if topicConfig.MaxRetryBackoff > 0 {
+		policy.MaximumBackoff = topicConfig.MaxRetryBackoff
+	}
+	return policy
 }
 
 func ParsePubsubConfig(config map[string]string) (PubsubConfig, error) {
@@ -0,0 +1,233 @@
+package pubsubutil_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/labiraus/go-utils/pkg/base"
+	"github.com/labiraus/go-utils/pkg/pubsubutil"
+	"github.com/labiraus/go-utils/pkg/pubsubutil/pubsubtest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+type created struct {
+	Item string `json:"item"`
+}
+
+var topics = map[string]pubsubutil.Topic{
+	"events": {Name: "events", Subscription: "events-sub", Encoding: pubsubutil.JSONEncoding},
+}
+
+func TestTypedPublishAndSubscribe(t *testing.T) {
+	h := pubsubtest.New(t, topics)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan created, 1)
+	traceIDs := make(chan string, 1)
+	_, err := pubsubutil.Subscribe(ctx, "events", func(ctx context.Context, value created, msg *pubsub.Message) error {
+		traceID, _ := ctx.Value(base.TraceID).(string)
+		traceIDs <- traceID
+		received <- value
+		return nil
+	})
+	assert.NoError(t, err)
+
+	ctx = context.WithValue(ctx, base.TraceID, "trace-1")
+	result, err := pubsubutil.Publish(ctx, "events", created{Item: "milk"})
+	assert.NoError(t, err)
+	id, err := result.Get(ctx)
+	assert.NoError(t, err)
+
+	select {
+	case value := <-received:
+		assert.Equal(t, created{Item: "milk"}, value)
+		assert.Equal(t, "trace-1", <-traceIDs)
+	case <-time.After(20 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	msg := h.AwaitAck(t, id, 5*time.Second)
+	assert.Equal(t, pubsubutil.JSONContentType, msg.Attributes[pubsubutil.ContentTypeAttribute])
+}
+
+func TestHandlerErrorsAreRedelivered(t *testing.T) {
+	h := pubsubtest.New(t, topics)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// count handler calls rather than polling the fake's delivery stats. The fake sometimes
+	// drops the nack, in which case the message only comes back once the client's 10s
+	// stream ack deadline runs out.
+	calls := make(chan string, 10)
+	var failed atomic.Bool
+	_, err := pubsubutil.Subscribe(ctx, "events", func(ctx context.Context, value created, msg *pubsub.Message) error {
+		calls <- value.Item
+		if !failed.Swap(true) {
+			return errors.New("try again")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	id := h.Publish(t, "events", []byte(`{"item":"eggs"}`), nil)
+	for range 2 {
+		select {
+		case item := <-calls:
+			assert.Equal(t, "eggs", item)
+		case <-time.After(20 * time.Second):
+			t.Fatal("message was not redelivered after the handler failed")
+		}
+	}
+	h.AwaitAck(t, id, 5*time.Second)
+}
+
+func TestPanickingHandlerDoesNotAck(t *testing.T) {
+	h := pubsubtest.New(t, topics)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := pubsubutil.SubscribeRaw(ctx, "events", func(ctx context.Context, msg *pubsub.Message) {
+		panic("poison")
+	})
+	assert.NoError(t, err)
+
+	id := h.Publish(t, "events", []byte("poison"), nil)
+	h.AwaitDeliveries(t, id, 1, 5*time.Second)
+	h.AssertNotAcked(t, id, 100*time.Millisecond)
+}
+
+func TestSubscriptionPauseResumeAndDrain(t *testing.T) {
+	h := pubsubtest.New(t, topics)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string, 2)
+	sub, err := pubsubutil.SubscribeRaw(ctx, "events", func(ctx context.Context, msg *pubsub.Message) {
+		received <- string(msg.Data)
+		msg.Ack()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, pubsubutil.SubscriptionReceiving, sub.State())
+
+	sub.Pause()
+	assert.Equal(t, pubsubutil.SubscriptionPaused, sub.State())
+	h.Publish(t, "events", []byte("while paused"), nil)
+	select {
+	case data := <-received:
+		t.Fatalf("received %v while paused", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	sub.Resume()
+	select {
+	case data := <-received:
+		assert.Equal(t, "while paused", data)
+	case <-time.After(20 * time.Second):
+		t.Fatal("message not delivered after resume")
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	assert.NoError(t, sub.Drain(drainCtx))
+	assert.Equal(t, pubsubutil.SubscriptionStopped, sub.State())
+	assert.Error(t, base.CheckReadiness())
+}
+
+func TestGoogleBroker(t *testing.T) {
+	h := pubsubtest.New(t, topics)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := pubsubutil.NewBroker(ctx, h.Config)
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	received := make(chan *pubsubutil.Message, 1)
+	assert.NoError(t, broker.Subscribe(ctx, "events", func(ctx context.Context, msg *pubsubutil.Message) {
+		msg.Ack()
+		received <- msg
+	}))
+
+	id, err := broker.Publish(ctx, "events", &pubsubutil.Message{Data: []byte("hello"), Attributes: map[string]string{"type": "greeting"}})
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, id, msg.ID)
+		assert.Equal(t, "greeting", msg.Attributes["type"])
+	case <-time.After(20 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	h.AwaitAck(t, id, 5*time.Second)
+}
+
+func TestExistingSubscriptionIsOnlyUpdatedWhenItDiffers(t *testing.T) {
+	// updates fail, so subscribing only works when no update is needed
+	server := pstest.NewServer(pstest.WithErrorInjection("UpdateSubscription", codes.PermissionDenied, "no update rights"))
+	defer server.Close()
+	host, port, err := net.SplitHostPort(server.Addr)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	topic := pubsubutil.Topic{
+		Name:               "events",
+		Subscription:       "events-sub",
+		CreateTopic:        true,
+		CreateSubscription: true,
+		AckDeadline:        20 * time.Second,
+		MinRetryBackoff:    time.Second,
+	}
+	config := pubsubutil.PubsubConfig{
+		Host:      host,
+		Port:      port,
+		Projectid: pubsubtest.ProjectID,
+		Emulator:  true,
+		Topics:    map[string]pubsubutil.Topic{"events": topic},
+	}
+	client, err := pubsubutil.NewClient(ctx, config)
+	assert.NoError(t, err)
+	defer client.Close(ctx)
+	_, err = client.SubscribeRaw(ctx, "events", func(ctx context.Context, msg *pubsub.Message) {})
+	assert.NoError(t, err)
+
+	// exactly once delivery enabled outside the config is left alone
+	t.Setenv("PUBSUB_EMULATOR_HOST", server.Addr)
+	raw, err := pubsub.NewClient(ctx, pubsubtest.ProjectID)
+	assert.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.CreateSubscription(ctx, "exactly-once-sub", pubsub.SubscriptionConfig{
+		Topic:                     raw.Topic("events"),
+		AckDeadline:               20 * time.Second,
+		RetryPolicy:               &pubsub.RetryPolicy{MinimumBackoff: time.Second},
+		EnableExactlyOnceDelivery: true,
+	})
+	assert.NoError(t, err)
+	exactlyOnce := topic
+	exactlyOnce.Subscription = "exactly-once-sub"
+	config.Topics = map[string]pubsubutil.Topic{"events": topic, "exactly-once": exactlyOnce}
+
+	restarted, err := pubsubutil.NewClient(ctx, config)
+	assert.NoError(t, err)
+	defer restarted.Close(ctx)
+	_, err = restarted.SubscribeRaw(ctx, "events", func(ctx context.Context, msg *pubsub.Message) {})
+	assert.NoError(t, err)
+	_, err = restarted.SubscribeRaw(ctx, "exactly-once", func(ctx context.Context, msg *pubsub.Message) {})
+	assert.NoError(t, err)
+
+	changed := topic
+	changed.AckDeadline = 30 * time.Second
+	config.Topics = map[string]pubsubutil.Topic{"events": changed}
+	reconfigured, err := pubsubutil.NewClient(ctx, config)
+	assert.NoError(t, err)
+	defer reconfigured.Close(ctx)
+	_, err = reconfigured.SubscribeRaw(ctx, "events", func(ctx context.Context, msg *pubsub.Message) {})
+	assert.ErrorContains(t, err, "no update rights")
+}
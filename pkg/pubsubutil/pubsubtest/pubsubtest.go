@@ -0,0 +1,109 @@
+// Package pubsubtest runs pubsubutil against the in-memory pstest fake so that publishers
+// and subscribers can be tested without an emulator or a Google project.
+package pubsubtest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/labiraus/go-utils/pkg/pubsubutil"
+)
+
+const ProjectID = "test-project"
+
+type Harness struct {
+	Server *pstest.Server
+	Client *pubsubutil.Client
+	Config pubsubutil.PubsubConfig
+}
+
+// New starts a fake server and points the pubsubutil package level client at it. Topics
+// and subscriptions are created on demand. Everything is torn down when the test ends.
+func New(t testing.TB, topics map[string]pubsubutil.Topic) *Harness {
+	t.Helper()
+	server := pstest.NewServer()
+	host, port, err := net.SplitHostPort(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := pubsubutil.PubsubConfig{
+		Host:      host,
+		Port:      port,
+		Projectid: ProjectID,
+		Emulator:  true,
+		Topics:    make(map[string]pubsubutil.Topic, len(topics)),
+	}
+	for id, topic := range topics {
+		topic.CreateTopic = true
+		topic.CreateSubscription = true
+		config.Topics[id] = topic
+	}
+
+	client, err := pubsubutil.Start(context.Background(), config)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client.Close(ctx)
+		server.Close()
+	})
+	return &Harness{Server: server, Client: client, Config: config}
+}
+
+// Publish sends raw data to the topic and returns the message ID
+func (h *Harness) Publish(t testing.TB, topicID string, data []byte, attributes map[string]string) string {
+	t.Helper()
+	ctx := context.Background()
+	topic, err := h.Client.Topic(ctx, topicID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes}).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// Await blocks until the message satisfies cond, failing the test after timeout
+func (h *Harness) Await(t testing.TB, id string, timeout time.Duration, cond func(*pstest.Message) bool) *pstest.Message {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		msg := h.Server.Message(id)
+		if msg != nil && cond(msg) {
+			return msg
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message %v did not reach the expected state within %v", id, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (h *Harness) AwaitAck(t testing.TB, id string, timeout time.Duration) *pstest.Message {
+	t.Helper()
+	return h.Await(t, id, timeout, func(msg *pstest.Message) bool { return msg.Acks > 0 })
+}
+
+func (h *Harness) AwaitDeliveries(t testing.TB, id string, deliveries int, timeout time.Duration) *pstest.Message {
+	t.Helper()
+	return h.Await(t, id, timeout, func(msg *pstest.Message) bool { return msg.Deliveries >= deliveries })
+}
+
+// AssertNotAcked fails if the message is acked within wait
+func (h *Harness) AssertNotAcked(t testing.TB, id string, wait time.Duration) {
+	t.Helper()
+	time.Sleep(wait)
+	if msg := h.Server.Message(id); msg != nil && msg.Acks > 0 {
+		t.Fatalf("message %v was acked %v times", id, msg.Acks)
+	}
+}
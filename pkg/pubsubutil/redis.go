@@ -0,0 +1,101 @@
+package pubsubutil
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"math"
+
+	"github.com/labiraus/go-utils/pkg/redisutil"
+)
+
+const orderingKeyAttribute = "orderingKey"
+
+var errNotAcked = errors.New("message was not acked")
+
+type redisBroker struct {
+	client *redisutil.Client
+	config PubsubConfig
+}
+
+func newRedisBroker(ctx context.Context, c PubsubConfig) (*redisBroker, error) {
+	client, err := redisutil.New(ctx, c.Redis)
+	if err != nil {
+		return nil, err
+	}
+	return &redisBroker{client: client, config: c}, nil
+}
+
+func (b *redisBroker) Publish(ctx context.Context, topicID string, msg *Message) (string, error) {
+	topic, err := topicConfig(b.config, topicID)
+	if err != nil {
+		return "", err
+	}
+
+	attributes := maps.Clone(msg.Attributes)
+	if msg.OrderingKey != "" {
+		if attributes == nil {
+			attributes = make(map[string]string, 1)
+		}
+		attributes[orderingKeyAttribute] = msg.OrderingKey
+	}
+	return b.client.PublishStream(ctx, redisutil.StreamConfig{Stream: topic.Name}, msg.Data, attributes)
+}
+
+func (b *redisBroker) Subscribe(ctx context.Context, topicID string, handler func(context.Context, *Message)) error {
+	topic, err := topicConfig(b.config, topicID)
+	if err != nil {
+		return err
+	}
+
+	handler = instrument(topic.Subscription, handler)
+	_, err = b.client.SubscribeStream(ctx, streamConfig(topic), func(ctx context.Context, sm *redisutil.StreamMessage) error {
+		acked := make(chan bool, 1)
+		attributes := sm.Attributes
+		orderingKey := attributes[orderingKeyAttribute]
+		delete(attributes, orderingKeyAttribute)
+
+		handler(ctx, &Message{
+			ID:              sm.ID,
+			Data:            sm.Data,
+			Attributes:      attributes,
+			OrderingKey:     orderingKey,
+			DeliveryAttempt: int(sm.DeliveryAttempt),
+			ack:             func() { acked <- true },
+			nack:            func() { acked <- false },
+		})
+
+		select {
+		case ok := <-acked:
+			if ok {
+				return nil
+			}
+		default:
+		}
+		return errNotAcked
+	})
+	return err
+}
+
+// streamConfig maps a topic onto a redis stream. Nacked entries stay pending and are
+// reclaimed once idle for MinRetryBackoff.
+func streamConfig(topic Topic) redisutil.StreamConfig {
+	config := redisutil.StreamConfig{
+		Stream:        topic.Name,
+		Group:         topic.Subscription,
+		Concurrency:   topic.Concurrency,
+		MaxDeliveries: int64(topic.MaxDeliveryAttempts),
+		DeadLetter:    topic.DeadLetterTopic,
+		ClaimIdle:     topic.MinRetryBackoff,
+	}
+	// redisutil defaults to dead-lettering after 5 deliveries, which matches Google Pub/Sub
+	// when there's a DeadLetterTopic. Without one every other broker retries forever.
+	if config.MaxDeliveries == 0 && config.DeadLetter == "" {
+		config.MaxDeliveries = math.MaxInt64
+	}
+	return config
+}
+
+func (b *redisBroker) Close() error {
+	return b.client.Close()
+}
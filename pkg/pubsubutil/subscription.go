@@ -0,0 +1,206 @@
+package pubsubutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/labiraus/go-utils/pkg/base"
+)
+
+const (
+	SubscriptionReceiving = "receiving"
+	SubscriptionPaused    = "paused"
+	SubscriptionDraining  = "draining"
+	SubscriptionStopped   = "stopped"
+)
+
+// recoveryPeriod is how long Receive has to run without failing to count as healthy again
+var recoveryPeriod = 30 * time.Second
+
+// Subscription is a handle on a running receiver. It is registered as a readiness check
+// that fails while receiving is erroring or once the subscription starts draining.
+type Subscription struct {
+	sub     *pubsub.Subscription
+	handler func(context.Context, *pubsub.Message)
+
+	mux      sync.Mutex
+	cancel   context.CancelFunc
+	resume   chan struct{}
+	draining bool
+	lastErr  error
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newSubscription(ctx context.Context, sub *pubsub.Subscription, handler func(context.Context, *pubsub.Message)) *Subscription {
+	s := &Subscription{
+		sub:     sub,
+		handler: handler,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	base.AddReadinessCheck("pubsub:"+sub.ID(), s.check)
+	go s.run(ctx)
+	return s
+}
+
+// run restarts Receive with backoff until ctx is done or the subscription is drained,
+// instead of giving up on the first transient error
+func (s *Subscription) run(ctx context.Context) {
+	defer close(s.done)
+	delay := time.Second
+	for {
+		s.mux.Lock()
+		resume := s.resume
+		s.mux.Unlock()
+		if resume != nil {
+			select {
+			case <-resume:
+			case <-s.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		receiveCtx, cancel := context.WithCancel(ctx)
+		s.mux.Lock()
+		if s.draining || s.resume != nil {
+			s.mux.Unlock()
+			cancel()
+			continue
+		}
+		s.cancel = cancel
+		s.mux.Unlock()
+
+		// a quiet subscription has no messages to prove it recovered, so a receiver that keeps
+		// running for a while clears the last error instead
+		recovered := time.AfterFunc(recoveryPeriod, func() {
+			s.mux.Lock()
+			s.lastErr = nil
+			s.mux.Unlock()
+		})
+		err := s.sub.Receive(receiveCtx, s.handle)
+		if !recovered.Stop() {
+			delay = time.Second
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.mux.Lock()
+		s.cancel = nil
+		if s.draining {
+			s.mux.Unlock()
+			return
+		}
+		if s.resume != nil || err == nil {
+			s.mux.Unlock()
+			continue
+		}
+		s.lastErr = err
+		s.mux.Unlock()
+
+		slog.ErrorContext(ctx, fmt.Sprintf("error receiving subscription %v, retrying in %v: %v", s.sub.ID(), delay, err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+func (s *Subscription) handle(ctx context.Context, msg *pubsub.Message) {
+	s.mux.Lock()
+	s.lastErr = nil
+	s.mux.Unlock()
+	s.handler(ctx, msg)
+}
+
+// Pause stops pulling messages. Messages already handed to the handler are allowed to finish.
+func (s *Subscription) Pause() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.resume != nil || s.draining {
+		return
+	}
+	s.resume = make(chan struct{})
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+func (s *Subscription) Resume() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.resume == nil {
+		return
+	}
+	close(s.resume)
+	s.resume = nil
+}
+
+// Drain stops pulling messages and waits for in-flight handlers to return. If ctx is done
+// first its error is returned and the handlers are left to finish in the background.
+func (s *Subscription) Drain(ctx context.Context) error {
+	s.mux.Lock()
+	if !s.draining {
+		s.draining = true
+		close(s.stop)
+		if s.cancel != nil {
+			s.cancel()
+		}
+	}
+	s.mux.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("draining subscription %v: %w", s.sub.ID(), ctx.Err())
+	}
+}
+
+// Done is closed once the subscription has stopped and no handlers are running
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) State() string {
+	select {
+	case <-s.done:
+		return SubscriptionStopped
+	default:
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	switch {
+	case s.draining:
+		return SubscriptionDraining
+	case s.resume != nil:
+		return SubscriptionPaused
+	}
+	return SubscriptionReceiving
+}
+
+func (s *Subscription) check() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.draining {
+		return fmt.Errorf("subscription %v is draining", s.sub.ID())
+	}
+	if s.lastErr != nil {
+		return fmt.Errorf("subscription %v: %w", s.sub.ID(), s.lastErr)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package pubsubutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuietSubscriptionRecoversReadiness(t *testing.T) {
+	period := recoveryPeriod
+	recoveryPeriod = 100 * time.Millisecond
+	defer func() { recoveryPeriod = period }()
+
+	server := pstest.NewServer()
+	defer server.Close()
+	t.Setenv("PUBSUB_EMULATOR_HOST", server.Addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := pubsub.NewClient(ctx, "test-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "quiet")
+	assert.NoError(t, err)
+
+	// receiving fails until the subscription exists
+	s := newSubscription(ctx, client.Subscription("quiet-sub"), func(ctx context.Context, msg *pubsub.Message) {
+		t.Errorf("unexpected message %v", msg.ID)
+	})
+	defer s.Drain(ctx)
+	assert.Eventually(t, func() bool { return s.check() != nil }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = client.CreateSubscription(ctx, "quiet-sub", pubsub.SubscriptionConfig{Topic: topic})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return s.check() == nil }, 5*time.Second, 10*time.Millisecond)
+}
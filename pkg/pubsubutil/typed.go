@@ -0,0 +1,176 @@
+package pubsubutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/labiraus/go-utils/pkg/base"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeAttribute = "content-type"
+	SchemaAttribute      = "schema"
+
+	JSONContentType     = "application/json"
+	ProtobufContentType = "application/protobuf"
+	RawContentType      = "application/octet-stream"
+
+	JSONEncoding     = "json"
+	ProtobufEncoding = "protobuf"
+)
+
+type publishOptions struct {
+	attributes  map[string]string
+	orderingKey string
+}
+
+type PublishOption func(*publishOptions)
+
+func WithAttributes(attributes map[string]string) PublishOption {
+	return func(o *publishOptions) {
+		o.attributes = attributes
+	}
+}
+
+// WithOrderingKey requires MessageOrdering on the topic
+func WithOrderingKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.orderingKey = key
+	}
+}
+
+// Publish encodes value for the topic and publishes it using the topic's batching settings.
+// The returned result resolves to the server message ID once the batch is sent.
+func Publish[T any](ctx context.Context, topicID string, value T, opts ...PublishOption) (*pubsub.PublishResult, error) {
+	options := publishOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	client, err := started()
+	if err != nil {
+		return nil, err
+	}
+	data, attributes, err := encode(value, client.config.Topics[topicID])
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(attributes, options.attributes)
+	if traceID, ok := ctx.Value(base.TraceID).(string); ok {
+		attributes[string(base.TraceID)] = traceID
+	}
+
+	topic, err := client.Topic(ctx, topicID)
+	if err != nil {
+		return nil, err
+	}
+	result := topic.Publish(ctx, &pubsub.Message{
+		Data:        data,
+		Attributes:  attributes,
+		OrderingKey: options.orderingKey,
+	})
+	return result, nil
+}
+
+// Subscribe decodes each message into T before calling handler. The message is acked when
+// handler returns nil and nacked when it returns an error or the payload can't be decoded.
+// The trace ID of the publisher is carried into the handler's context.
+func Subscribe[T any](ctx context.Context, topicID string, handler func(context.Context, T, *pubsub.Message) error) (*Subscription, error) {
+	client, err := started()
+	if err != nil {
+		return nil, err
+	}
+	topicConfig := client.config.Topics[topicID]
+	return client.SubscribeRaw(ctx, topicID, func(ctx context.Context, msg *pubsub.Message) {
+		if traceID, ok := msg.Attributes[string(base.TraceID)]; ok {
+			ctx = context.WithValue(ctx, base.TraceID, traceID)
+		}
+
+		value, err := decode[T](msg.Data, msg.Attributes[ContentTypeAttribute], topicConfig)
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("failed to decode message %v on %v: %v", msg.ID, topicConfig.Subscription, err))
+			countMessage(topicConfig.Subscription, resultDecodeError)
+			msg.Nack()
+			return
+		}
+
+		if err = handler(ctx, value, msg); err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("failed to handle message %v on %v: %v", msg.ID, topicConfig.Subscription, err))
+			countMessage(topicConfig.Subscription, resultNack)
+			msg.Nack()
+			return
+		}
+		countMessage(topicConfig.Subscription, resultAck)
+		msg.Ack()
+	})
+}
+
+func useProtobuf(topicConfig Topic) bool {
+	switch topicConfig.Encoding {
+	case ProtobufEncoding:
+		return true
+	case JSONEncoding:
+		return false
+	}
+	return UseProtobuf
+}
+
+func encode[T any](value T, topicConfig Topic) ([]byte, map[string]string, error) {
+	if raw, ok := any(value).([]byte); ok {
+		return raw, map[string]string{ContentTypeAttribute: RawContentType}, nil
+	}
+
+	if useProtobuf(topicConfig) {
+		msg, ok := any(value).(proto.Message)
+		if !ok {
+			return nil, nil, fmt.Errorf("%T is not a protobuf message", value)
+		}
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal %T: %w", value, err)
+		}
+		return data, map[string]string{
+			ContentTypeAttribute: ProtobufContentType,
+			SchemaAttribute:      string(msg.ProtoReflect().Descriptor().FullName()),
+		}, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal %T: %w", value, err)
+	}
+	return data, map[string]string{
+		ContentTypeAttribute: JSONContentType,
+		SchemaAttribute:      strings.TrimPrefix(fmt.Sprintf("%T", value), "*"),
+	}, nil
+}
+
+// decode trusts the content-type attribute over the topic's encoding so that producers can
+// migrate between encodings without stranding messages already in flight
+func decode[T any](data []byte, contentType string, topicConfig Topic) (T, error) {
+	var value T
+	if _, ok := any(value).([]byte); ok {
+		return any(data).(T), nil
+	}
+
+	if contentType == ProtobufContentType || (contentType == "" && useProtobuf(topicConfig)) {
+		msg, ok := any(value).(proto.Message)
+		if !ok {
+			return value, fmt.Errorf("%T is not a protobuf message", value)
+		}
+		msg = msg.ProtoReflect().New().Interface()
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return value, err
+		}
+		return msg.(T), nil
+	}
+
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
@@ -0,0 +1,81 @@
+package pubsubutil
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testEvent struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestEncodeJSONSetsContentTypeAndSchema(t *testing.T) {
+	data, attributes, err := encode(testEvent{Name: "created", Count: 2}, Topic{Encoding: JSONEncoding})
+	assert.NoError(t, err)
+	assert.Equal(t, JSONContentType, attributes[ContentTypeAttribute])
+	assert.Equal(t, "pubsubutil.testEvent", attributes[SchemaAttribute])
+
+	value, err := decode[testEvent](data, attributes[ContentTypeAttribute], Topic{})
+	assert.NoError(t, err)
+	assert.Equal(t, testEvent{Name: "created", Count: 2}, value)
+}
+
+func TestEncodeProtobuf(t *testing.T) {
+	data, attributes, err := encode(wrapperspb.String("hello"), Topic{Encoding: ProtobufEncoding})
+	assert.NoError(t, err)
+	assert.Equal(t, ProtobufContentType, attributes[ContentTypeAttribute])
+	assert.Equal(t, "google.protobuf.StringValue", attributes[SchemaAttribute])
+
+	value, err := decode[*wrapperspb.StringValue](data, attributes[ContentTypeAttribute], Topic{})
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(wrapperspb.String("hello"), value))
+}
+
+func TestEncodeProtobufRejectsPlainStructs(t *testing.T) {
+	_, _, err := encode(testEvent{}, Topic{Encoding: ProtobufEncoding})
+	assert.Error(t, err)
+}
+
+func TestUseProtobufFlagIsTheDefaultEncoding(t *testing.T) {
+	UseProtobuf = true
+	defer func() { UseProtobuf = false }()
+
+	_, attributes, err := encode(wrapperspb.Int64(3), Topic{})
+	assert.NoError(t, err)
+	assert.Equal(t, ProtobufContentType, attributes[ContentTypeAttribute])
+
+	_, attributes, err = encode(testEvent{}, Topic{Encoding: JSONEncoding})
+	assert.NoError(t, err)
+	assert.Equal(t, JSONContentType, attributes[ContentTypeAttribute])
+}
+
+func TestRawBytesPassThrough(t *testing.T) {
+	data, attributes, err := encode([]byte("raw"), Topic{Encoding: ProtobufEncoding})
+	assert.NoError(t, err)
+	assert.Equal(t, RawContentType, attributes[ContentTypeAttribute])
+
+	value, err := decode[[]byte](data, attributes[ContentTypeAttribute], Topic{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("raw"), value)
+}
+
+func TestPackageFunctionsRequireStart(t *testing.T) {
+	started := defaultClient
+	defaultClient = nil
+	defer func() { defaultClient = started }()
+
+	_, err := Publish(context.Background(), "events", testEvent{Name: "a"})
+	assert.ErrorIs(t, err, ErrNotStarted)
+	_, err = Subscribe(context.Background(), "events", func(context.Context, testEvent, *pubsub.Message) error { return nil })
+	assert.ErrorIs(t, err, ErrNotStarted)
+	_, err = SubscribeRaw(context.Background(), "events", func(context.Context, *pubsub.Message) {})
+	assert.ErrorIs(t, err, ErrNotStarted)
+	_, err = GetTopic(context.Background(), "events")
+	assert.ErrorIs(t, err, ErrNotStarted)
+}
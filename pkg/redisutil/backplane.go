@@ -0,0 +1,48 @@
+package redisutil
+
+import (
+	"context"
+	"fmt"
+)
+
+// Backplane relays messages to every subscriber of a redis pub/sub channel, which makes it
+// a websocketutil.Backplane. Delivery is at-most-once: replicas that are disconnected when
+// a message is published miss it.
+type Backplane struct {
+	client  *Client
+	channel string
+}
+
+func NewBackplane(client *Client, channel string) *Backplane {
+	return &Backplane{client: client, channel: channel}
+}
+
+func (b *Backplane) Publish(ctx context.Context, data []byte) error {
+	return b.client.Publish(ctx, b.channel, data).Err()
+}
+
+// Subscribe returns once the subscription is confirmed and calls handler until ctx is done
+func (b *Backplane) Subscribe(ctx context.Context, handler func(data []byte)) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return fmt.Errorf("failed to subscribe to %v: %w", b.channel, err)
+	}
+
+	go func() {
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				handler([]byte(msg.Payload))
+			}
+		}
+	}()
+	return nil
+}
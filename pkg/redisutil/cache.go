@@ -0,0 +1,242 @@
+package redisutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	mrand "math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+var ErrNotFound = errors.New("not found")
+
+const (
+	negativeMarker byte = 0
+	valueMarker    byte = 1
+)
+
+type CacheConfig[K comparable, V any] struct {
+	// Name prefixes every redis key and names the invalidation channel
+	Name  string
+	Codec Codec[V]
+	TTL   time.Duration
+	// Jitter spreads expiry by up to this fraction of TTL either way, e.g. 0.1
+	Jitter float64
+	// NegativeTTL caches ErrNotFound from Loader, zero disables negative caching
+	NegativeTTL time.Duration
+	// LocalSize enables the in-process tier, LocalTTL defaults to TTL
+	LocalSize int
+	LocalTTL  time.Duration
+	// Loader fills misses, concurrent misses for the same key share a single call
+	Loader  func(ctx context.Context, key K) (V, error)
+	KeyFunc func(key K) string
+}
+
+// Cache is a typed read-through cache. With a nil client it only uses the in-process tier;
+// with a client and LocalSize set, writes on any replica evict the key from every other
+// replica's local tier over redis pub/sub.
+type Cache[K comparable, V any] struct {
+	client  *Client
+	config  CacheConfig[K, V]
+	local   *lru[V]
+	group   singleflight.Group
+	origin  string
+	channel string
+}
+
+func NewCache[K comparable, V any](ctx context.Context, client *Client, config CacheConfig[K, V]) (*Cache[K, V], error) {
+	if client == nil && config.LocalSize <= 0 {
+		return nil, fmt.Errorf("cache %v needs a redis client or a local size", config.Name)
+	}
+	if config.Codec == nil {
+		config.Codec = JSONCodec[V]{}
+	}
+	if config.KeyFunc == nil {
+		config.KeyFunc = func(key K) string { return fmt.Sprint(key) }
+	}
+	if config.LocalTTL <= 0 || (config.TTL > 0 && config.LocalTTL > config.TTL) {
+		config.LocalTTL = config.TTL
+	}
+
+	c := &Cache[K, V]{
+		client:  client,
+		config:  config,
+		origin:  randomID(),
+		channel: "cache:" + config.Name + ":invalidate",
+	}
+	if config.LocalSize > 0 {
+		c.local = newLRU[V](config.LocalSize)
+	}
+
+	if c.client != nil && c.local != nil {
+		sub := c.client.Subscribe(ctx, c.channel)
+		if _, err := sub.Receive(ctx); err != nil {
+			sub.Close()
+			return nil, fmt.Errorf("failed to subscribe to %v: %w", c.channel, err)
+		}
+		go c.listen(ctx, sub)
+	}
+	return c, nil
+}
+
+func (c *Cache[K, V]) Get(ctx context.Context, key K) (V, error) {
+	cacheKey := c.key(key)
+	if c.local != nil {
+		if entry, ok := c.local.get(cacheKey); ok {
+			if entry.negative {
+				return entry.value, ErrNotFound
+			}
+			return entry.value, nil
+		}
+	}
+
+	result, err, _ := c.group.Do(cacheKey, func() (any, error) {
+		return c.fetch(ctx, key, cacheKey)
+	})
+	value, _ := result.(V)
+	return value, err
+}
+
+func (c *Cache[K, V]) Set(ctx context.Context, key K, value V) error {
+	cacheKey := c.key(key)
+	data, err := c.config.Codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %v: %w", cacheKey, err)
+	}
+	return c.store(ctx, cacheKey, value, append([]byte{valueMarker}, data...), false, c.config.TTL)
+}
+
+func (c *Cache[K, V]) Delete(ctx context.Context, key K) error {
+	cacheKey := c.key(key)
+	if c.local != nil {
+		c.local.delete(cacheKey)
+	}
+	if c.client == nil {
+		return nil
+	}
+	if err := c.client.Del(ctx, cacheKey).Err(); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, cacheKey)
+}
+
+func (c *Cache[K, V]) fetch(ctx context.Context, key K, cacheKey string) (V, error) {
+	var value V
+	if c.client != nil {
+		data, err := c.client.Get(ctx, cacheKey).Bytes()
+		switch {
+		case err == nil && len(data) > 0 && data[0] == negativeMarker:
+			if c.local != nil {
+				c.local.set(cacheKey, value, true, c.localTTL(c.config.NegativeTTL))
+			}
+			return value, ErrNotFound
+		case err == nil && len(data) > 0:
+			if err = c.config.Codec.Unmarshal(data[1:], &value); err != nil {
+				return value, fmt.Errorf("failed to decode %v: %w", cacheKey, err)
+			}
+			if c.local != nil {
+				c.local.set(cacheKey, value, false, c.localTTL(c.config.LocalTTL))
+			}
+			return value, nil
+		case err != nil && !errors.Is(err, redis.Nil):
+			return value, err
+		}
+	}
+
+	if c.config.Loader == nil {
+		return value, ErrNotFound
+	}
+
+	value, err := c.config.Loader(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		if c.config.NegativeTTL > 0 {
+			if storeErr := c.store(ctx, cacheKey, value, []byte{negativeMarker}, true, c.config.NegativeTTL); storeErr != nil {
+				slog.WarnContext(ctx, "failed to cache missing key", "key", cacheKey, "error", storeErr)
+			}
+		}
+		return value, ErrNotFound
+	}
+	if err != nil {
+		return value, err
+	}
+
+	data, err := c.config.Codec.Marshal(value)
+	if err != nil {
+		return value, fmt.Errorf("failed to encode %v: %w", cacheKey, err)
+	}
+	if err = c.store(ctx, cacheKey, value, append([]byte{valueMarker}, data...), false, c.config.TTL); err != nil {
+		slog.WarnContext(ctx, "failed to cache loaded key", "key", cacheKey, "error", err)
+	}
+	return value, nil
+}
+
+func (c *Cache[K, V]) store(ctx context.Context, cacheKey string, value V, data []byte, negative bool, ttl time.Duration) error {
+	if c.local != nil {
+		localTTL := c.config.LocalTTL
+		if negative {
+			localTTL = ttl
+		}
+		c.local.set(cacheKey, value, negative, c.localTTL(localTTL))
+	}
+	if c.client == nil {
+		return nil
+	}
+	if err := c.client.Set(ctx, cacheKey, data, c.jitter(ttl)).Err(); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, cacheKey)
+}
+
+func (c *Cache[K, V]) invalidate(ctx context.Context, cacheKey string) error {
+	if c.local == nil {
+		return nil
+	}
+	return c.client.Publish(ctx, c.channel, c.origin+":"+cacheKey).Err()
+}
+
+func (c *Cache[K, V]) listen(ctx context.Context, sub *redis.PubSub) {
+	defer sub.Close()
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			origin, cacheKey, found := strings.Cut(msg.Payload, ":")
+			if found && origin != c.origin {
+				c.local.delete(cacheKey)
+			}
+		}
+	}
+}
+
+func (c *Cache[K, V]) key(key K) string {
+	return c.config.Name + ":" + c.config.KeyFunc(key)
+}
+
+// localTTL falls back to a long lived local entry when the cache has no expiry
+func (c *Cache[K, V]) localTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return 24 * time.Hour
+	}
+	return c.jitter(ttl)
+}
+
+func (c *Cache[K, V]) jitter(ttl time.Duration) time.Duration {
+	if ttl <= 0 || c.config.Jitter <= 0 {
+		return ttl
+	}
+	spread := time.Duration(float64(ttl) * c.config.Jitter)
+	if spread <= 0 {
+		return ttl
+	}
+	return ttl - spread + mrand.N(2*spread)
+}
@@ -0,0 +1,124 @@
+package redisutil
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCacheLoaderSharedBetweenCallers(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	cache, err := NewCache(ctx, client, CacheConfig[int, string]{
+		Name: "users",
+		TTL:  time.Minute,
+		Loader: func(ctx context.Context, key int) (string, error) {
+			calls.Add(1)
+			<-release
+			return "user", nil
+		},
+	})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := cache.Get(ctx, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, "user", value)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	value, err := client.Exists(ctx, "users:1").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+}
+
+func TestCacheNegativeCaching(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	cache, err := NewCache(ctx, client, CacheConfig[string, string]{
+		Name:        "missing",
+		TTL:         time.Minute,
+		NegativeTTL: time.Minute,
+		Loader: func(ctx context.Context, key string) (string, error) {
+			calls.Add(1)
+			return "", ErrNotFound
+		},
+	})
+	assert.NoError(t, err)
+
+	for range 3 {
+		_, err = cache.Get(ctx, "key")
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestCacheInvalidatesOtherReplicas(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := CacheConfig[string, *wrapperspb.StringValue]{
+		Name:      "shared",
+		Codec:     ProtoCodec[*wrapperspb.StringValue]{},
+		TTL:       time.Minute,
+		LocalSize: 10,
+	}
+	first, err := NewCache(ctx, client, config)
+	assert.NoError(t, err)
+	second, err := NewCache(ctx, client, config)
+	assert.NoError(t, err)
+
+	assert.NoError(t, first.Set(ctx, "key", wrapperspb.String("old")))
+	value, err := second.Get(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", value.GetValue())
+
+	assert.NoError(t, first.Set(ctx, "key", wrapperspb.String("new")))
+	assert.Eventually(t, func() bool {
+		value, err := second.Get(ctx, "key")
+		return err == nil && value.GetValue() == "new"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheLocalOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := NewCache(ctx, nil, CacheConfig[string, []int]{
+		Name:      "local",
+		Codec:     GobCodec[[]int]{},
+		TTL:       time.Minute,
+		LocalSize: 1,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, cache.Set(ctx, "a", []int{1}))
+	assert.NoError(t, cache.Set(ctx, "b", []int{2}))
+
+	_, err = cache.Get(ctx, "a")
+	assert.ErrorIs(t, err, ErrNotFound)
+	value, err := cache.Get(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, value)
+}
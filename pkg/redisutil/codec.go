@@ -0,0 +1,54 @@
+package redisutil
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"google.golang.org/protobuf/proto"
+)
+
+type Codec[V any] interface {
+	Marshal(value V) ([]byte, error)
+	Unmarshal(data []byte, value *V) error
+}
+
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Marshal(value V) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[V]) Unmarshal(data []byte, value *V) error {
+	return json.Unmarshal(data, value)
+}
+
+type GobCodec[V any] struct{}
+
+func (GobCodec[V]) Marshal(value V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[V]) Unmarshal(data []byte, value *V) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// ProtoCodec encodes generated message pointers such as *types.Message
+type ProtoCodec[V proto.Message] struct{}
+
+func (ProtoCodec[V]) Marshal(value V) ([]byte, error) {
+	return proto.Marshal(value)
+}
+
+func (ProtoCodec[V]) Unmarshal(data []byte, value *V) error {
+	msg := (*value).ProtoReflect().New().Interface()
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return err
+	}
+	*value = msg.(V)
+	return nil
+}
@@ -0,0 +1,68 @@
+package redisutil
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	idempotencyPrefix = "idempotency:"
+	// an empty value marks a key which is reserved but has no stored response yet
+	idempotencyPending = ""
+)
+
+var (
+	// reserveIdempotencyScript returns the existing value or false once it has reserved the key, in one step so the
+	// key can't expire between checking and reading it
+	reserveIdempotencyScript = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value then
+	return value
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return false`)
+	extendIdempotencyScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// IdempotencyStore satisfies api.IdempotencyStore so that idempotency keys are shared
+// between replicas.
+type IdempotencyStore struct {
+	client *Client
+}
+
+func NewIdempotencyStore(client *Client) *IdempotencyStore {
+	return &IdempotencyStore{client: client}
+}
+
+func (s *IdempotencyStore) Reserve(ctx context.Context, key string, ttl time.Duration) ([]byte, bool, error) {
+	value, err := reserveIdempotencyScript.Run(ctx, s.client, []string{idempotencyPrefix + key}, idempotencyPending, ttl.Milliseconds()).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if value == idempotencyPending {
+		return nil, false, nil
+	}
+	return []byte(value), false, nil
+}
+
+func (s *IdempotencyStore) Extend(ctx context.Context, key string, ttl time.Duration) error {
+	return extendIdempotencyScript.Run(ctx, s.client, []string{idempotencyPrefix + key}, idempotencyPending, ttl.Milliseconds()).Err()
+}
+
+func (s *IdempotencyStore) Save(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, idempotencyPrefix+key, value, ttl).Err()
+}
+
+func (s *IdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, idempotencyPrefix+key).Err()
+}
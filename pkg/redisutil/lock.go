@@ -0,0 +1,234 @@
+package redisutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrNotAcquired = errors.New("not acquired")
+	ErrLeaseLost   = errors.New("lease lost")
+)
+
+// Keys share a hash tag so the lock and its fencing counter live on the same cluster slot
+var (
+	acquireLockScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0`)
+	releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+	extendLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+type LockConfig struct {
+	// TTL is the lease length, the lease is renewed every TTL/3 while the lock is held
+	TTL           time.Duration
+	RetryInterval time.Duration
+}
+
+// Locker hands out named mutual exclusion locks. Given a single client the lock lives on
+// that node or cluster; given several independent clients, see NewRedlockClients, a lock is
+// only held while a majority of them agree.
+type Locker struct {
+	clients []*Client
+	config  LockConfig
+}
+
+type Lock struct {
+	// Token increases with every acquisition so that downstream writes can reject a
+	// holder whose lease has silently expired. With redlock it's the highest of the
+	// counters on the nodes that granted the lock, so it only keeps increasing while a
+	// majority of nodes keep their counters. A node that restarts without persistence or
+	// fails over to a lagging replica can make a later lock's token smaller.
+	Token int64
+	lease *lease
+}
+
+func NewLocker(config LockConfig, clients ...*Client) *Locker {
+	if config.TTL <= 0 {
+		config.TTL = 30 * time.Second
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 100 * time.Millisecond
+	}
+	return &Locker{clients: clients, config: config}
+}
+
+// NewRedlockClients connects to every config entry as an independent node rather than as a
+// cluster, for use with NewLocker.
+func NewRedlockClients(ctx context.Context, config map[string]RedisConfig) ([]*Client, error) {
+	clients := make([]*Client, 0, len(config))
+	for k, v := range config {
+		client, err := New(ctx, map[string]RedisConfig{k: v})
+		if err != nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// Acquire blocks until the lock is held or ctx is done. The lock is released when ctx is
+// cancelled, and the lock's Context is cancelled if the lease cannot be renewed.
+func (l *Locker) Acquire(ctx context.Context, name string) (*Lock, error) {
+	for {
+		lock, err := l.TryAcquire(ctx, name)
+		if !errors.Is(err, ErrNotAcquired) {
+			return lock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.config.RetryInterval):
+		}
+	}
+}
+
+func (l *Locker) TryAcquire(ctx context.Context, name string) (*Lock, error) {
+	key := "lock:{" + name + "}"
+	fenceKey := key + ":fence"
+	value := randomID()
+	ttl := l.config.TTL.Milliseconds()
+
+	start := time.Now()
+	var token int64
+	var lastErr error
+	acquired, failed := 0, 0
+	for _, client := range l.clients {
+		result, err := acquireLockScript.Run(ctx, client, []string{key, fenceKey}, value, ttl).Int64()
+		if err != nil {
+			slog.WarnContext(ctx, "failed to acquire lock", "lock", name, "error", err)
+			lastErr = err
+			failed++
+			continue
+		}
+		if result > 0 {
+			acquired++
+			token = max(token, result)
+		}
+	}
+
+	// allow for clock drift between nodes as in the redlock algorithm
+	drift := l.config.TTL/100 + 2*time.Millisecond
+	if acquired < l.quorum() || time.Since(start)+drift >= l.config.TTL {
+		l.release(context.WithoutCancel(ctx), key, value)
+		if failed == len(l.clients) {
+			return nil, fmt.Errorf("failed to acquire lock %v: %w", name, lastErr)
+		}
+		return nil, fmt.Errorf("lock %v: %w", name, ErrNotAcquired)
+	}
+
+	lock := &Lock{Token: token}
+	lock.lease = startLease(ctx, l.config.TTL, func(ctx context.Context) bool {
+		return l.extend(ctx, key, value)
+	}, func(ctx context.Context) {
+		l.release(ctx, key, value)
+	})
+	return lock, nil
+}
+
+// Context is cancelled once the lock is released or its lease is lost
+func (l *Lock) Context() context.Context {
+	return l.lease.ctx
+}
+
+func (l *Lock) Release(ctx context.Context) error {
+	return l.lease.stop(ctx)
+}
+
+func (l *Locker) quorum() int {
+	return len(l.clients)/2 + 1
+}
+
+func (l *Locker) extend(ctx context.Context, key, value string) bool {
+	extended := 0
+	for _, client := range l.clients {
+		result, err := extendLockScript.Run(ctx, client, []string{key}, value, l.config.TTL.Milliseconds()).Int64()
+		if err == nil && result == 1 {
+			extended++
+		}
+	}
+	return extended >= l.quorum()
+}
+
+func (l *Locker) release(ctx context.Context, key, value string) {
+	for _, client := range l.clients {
+		if err := releaseLockScript.Run(ctx, client, []string{key}, value).Err(); err != nil {
+			slog.WarnContext(ctx, "failed to release lock", "key", key, "error", err)
+		}
+	}
+}
+
+// lease keeps a claim alive until it is stopped, its parent context ends or renewal fails
+type lease struct {
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func startLease(parent context.Context, ttl time.Duration, renew func(context.Context) bool, release func(context.Context)) *lease {
+	ctx, cancel := context.WithCancelCause(parent)
+	l := &lease{
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(l.done)
+		defer release(context.WithoutCancel(parent))
+
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stopped:
+				cancel(context.Canceled)
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !renew(ctx) {
+					slog.WarnContext(ctx, "lease lost")
+					cancel(ErrLeaseLost)
+					return
+				}
+			}
+		}
+	}()
+	return l
+}
+
+func (l *lease) stop(ctx context.Context) error {
+	l.once.Do(func() { close(l.stopped) })
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if cause := context.Cause(l.ctx); errors.Is(cause, ErrLeaseLost) {
+		return cause
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package redisutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockIsExclusiveWithIncreasingTokens(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx := context.Background()
+	locker := NewLocker(LockConfig{TTL: time.Second}, client)
+
+	first, err := locker.TryAcquire(ctx, "snapshot")
+	assert.NoError(t, err)
+
+	_, err = locker.TryAcquire(ctx, "snapshot")
+	assert.ErrorIs(t, err, ErrNotAcquired)
+
+	assert.NoError(t, first.Release(ctx))
+	assert.Error(t, first.Context().Err())
+
+	second, err := locker.TryAcquire(ctx, "snapshot")
+	assert.NoError(t, err)
+	assert.Greater(t, second.Token, first.Token)
+	assert.NoError(t, second.Release(ctx))
+}
+
+func TestLockReleasedWhenContextCancelled(t *testing.T) {
+	_, client := startMiniredis(t)
+	locker := NewLocker(LockConfig{TTL: time.Second, RetryInterval: 10 * time.Millisecond}, client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lock, err := locker.Acquire(ctx, "snapshot")
+	assert.NoError(t, err)
+	cancel()
+	<-lock.Context().Done()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+	lock, err = locker.Acquire(waitCtx, "snapshot")
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release(waitCtx))
+}
+
+func TestLockLeaseLost(t *testing.T) {
+	server, client := startMiniredis(t)
+	ctx := context.Background()
+	locker := NewLocker(LockConfig{TTL: 150 * time.Millisecond}, client)
+
+	lock, err := locker.TryAcquire(ctx, "snapshot")
+	assert.NoError(t, err)
+	server.Del("lock:{snapshot}")
+
+	select {
+	case <-lock.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("lease was not lost")
+	}
+	assert.ErrorIs(t, lock.Release(ctx), ErrLeaseLost)
+}
+
+func TestRedlockNeedsQuorum(t *testing.T) {
+	servers := make([]*miniredis.Miniredis, 3)
+	config := make(map[string]RedisConfig, 3)
+	for i := range servers {
+		servers[i] = miniredis.RunT(t)
+		config[servers[i].Addr()] = RedisConfig{Host: servers[i].Host(), Port: servers[i].Port()}
+	}
+	clients, err := NewRedlockClients(context.Background(), config)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	locker := NewLocker(LockConfig{TTL: time.Second}, clients...)
+
+	servers[0].Close()
+	lock, err := locker.TryAcquire(ctx, "snapshot")
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release(ctx))
+
+	// take the lock on one of the remaining nodes so that no majority is available
+	var live *Client
+	for _, client := range clients {
+		if client.Ping(ctx).Err() == nil {
+			live = client
+			break
+		}
+	}
+	other, err := NewLocker(LockConfig{TTL: time.Second}, live).TryAcquire(ctx, "snapshot")
+	assert.NoError(t, err)
+	_, err = locker.TryAcquire(ctx, "snapshot")
+	assert.ErrorIs(t, err, ErrNotAcquired)
+	assert.NoError(t, other.Release(ctx))
+}
+
+func TestSemaphoreLimit(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx := context.Background()
+	semaphore := NewSemaphore(client, "writers", 2, LockConfig{TTL: time.Second})
+
+	first, err := semaphore.TryAcquire(ctx)
+	assert.NoError(t, err)
+	second, err := semaphore.TryAcquire(ctx)
+	assert.NoError(t, err)
+	_, err = semaphore.TryAcquire(ctx)
+	assert.ErrorIs(t, err, ErrNotAcquired)
+
+	assert.NoError(t, first.Release(ctx))
+	third, err := semaphore.TryAcquire(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, second.Release(ctx))
+	assert.NoError(t, third.Release(ctx))
+}
@@ -0,0 +1,77 @@
+package redisutil
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry[V any] struct {
+	key      string
+	value    V
+	negative bool
+	expires  time.Time
+}
+
+// lru is a fixed size in-process cache with per-entry expiry
+type lru[V any] struct {
+	mux     sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLRU[V any](size int) *lru[V] {
+	return &lru[V]{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (l *lru[V]) get(key string) (lruEntry[V], bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	element, ok := l.entries[key]
+	if !ok {
+		return lruEntry[V]{}, false
+	}
+	entry := element.Value.(*lruEntry[V])
+	if time.Now().After(entry.expires) {
+		l.order.Remove(element)
+		delete(l.entries, key)
+		return lruEntry[V]{}, false
+	}
+	l.order.MoveToFront(element)
+	return *entry, true
+}
+
+func (l *lru[V]) set(key string, value V, negative bool, ttl time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	entry := &lruEntry[V]{key: key, value: value, negative: negative, expires: time.Now().Add(ttl)}
+	if element, ok := l.entries[key]; ok {
+		element.Value = entry
+		l.order.MoveToFront(element)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(entry)
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+func (l *lru[V]) delete(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if element, ok := l.entries[key]; ok {
+		l.order.Remove(element)
+		delete(l.entries, key)
+	}
+}
@@ -0,0 +1,232 @@
+package redisutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	PresenceJoin   = "join"
+	PresenceLeave  = "leave"
+	PresenceExpire = "expire"
+	PresenceUpdate = "update"
+)
+
+// Room members live in a sorted set scored by heartbeat expiry, with their metadata in a
+// hash alongside it. Every change is published on the room's event channel.
+var (
+	joinScript = redis.NewScript(`
+local now = redis.call("TIME")
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local added = redis.call("ZADD", KEYS[1], nowMs + tonumber(ARGV[2]), ARGV[1])
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+if added == 1 then
+	redis.call("PUBLISH", ARGV[4], "join:" .. ARGV[1])
+end
+return added`)
+	heartbeatScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+local now = redis.call("TIME")
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+redis.call("ZADD", KEYS[1], "XX", nowMs + tonumber(ARGV[2]), ARGV[1])
+return 1`)
+	updateScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+redis.call("PUBLISH", ARGV[3], "update:" .. ARGV[1])
+return 1`)
+	leaveScript = redis.NewScript(`
+local removed = redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+if removed == 1 then
+	redis.call("PUBLISH", ARGV[2], "leave:" .. ARGV[1])
+end
+return removed`)
+	sweepScript = redis.NewScript(`
+local now = redis.call("TIME")
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", nowMs)
+for _, member in ipairs(expired) do
+	if redis.call("ZREM", KEYS[1], member) == 1 then
+		redis.call("HDEL", KEYS[2], member)
+		redis.call("PUBLISH", ARGV[1], "expire:" .. member)
+	end
+end
+return #expired`)
+	membersScript = redis.NewScript(`
+local now = redis.call("TIME")
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+return redis.call("ZRANGEBYSCORE", KEYS[1], "(" .. nowMs, "+inf")`)
+)
+
+type Presence struct {
+	client *Client
+	ttl    time.Duration
+}
+
+type PresenceEvent struct {
+	Room   string
+	Member string
+	// Type is PresenceJoin, PresenceLeave, PresenceExpire or PresenceUpdate
+	Type string
+}
+
+type Member struct {
+	ID       string
+	Metadata map[string]string
+}
+
+// Session is a member's heartbeated presence in a room
+type Session struct {
+	presence *Presence
+	room     string
+	member   string
+	lease    *lease
+}
+
+// NewPresence tracks room membership across replicas. Members that stop heartbeating
+// disappear from queries after ttl and are announced as expired by Watch.
+func NewPresence(client *Client, ttl time.Duration) *Presence {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return &Presence{client: client, ttl: ttl}
+}
+
+// Join marks member present in room until the session is left or ctx is done
+func (p *Presence) Join(ctx context.Context, room, member string, metadata map[string]string) (*Session, error) {
+	keys := presenceKeys(room)
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := p.ttl.Milliseconds()
+	if err = joinScript.Run(ctx, p.client, keys, member, ttl, data, presenceChannel(room)).Err(); err != nil {
+		return nil, fmt.Errorf("failed to join room %v: %w", room, err)
+	}
+
+	session := &Session{presence: p, room: room, member: member}
+	session.lease = startLease(ctx, p.ttl, func(ctx context.Context) bool {
+		result, err := heartbeatScript.Run(ctx, p.client, keys, member, ttl).Int64()
+		return err == nil && result == 1
+	}, func(ctx context.Context) {
+		if err := leaveScript.Run(ctx, p.client, keys, member, presenceChannel(room)).Err(); err != nil {
+			slog.WarnContext(ctx, "failed to leave room", "room", room, "member", member, "error", err)
+		}
+	})
+	return session, nil
+}
+
+// Context is cancelled once the session is left or its heartbeat is lost
+func (s *Session) Context() context.Context {
+	return s.lease.ctx
+}
+
+// SetMetadata replaces the member's metadata, failing with ErrLeaseLost once the member is
+// no longer present
+func (s *Session) SetMetadata(ctx context.Context, metadata map[string]string) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	result, err := updateScript.Run(ctx, s.presence.client, presenceKeys(s.room), s.member, data, presenceChannel(s.room)).Int64()
+	if err != nil {
+		return fmt.Errorf("failed to update %v in room %v: %w", s.member, s.room, err)
+	}
+	if result == 0 {
+		return fmt.Errorf("member %v in room %v: %w", s.member, s.room, ErrLeaseLost)
+	}
+	return nil
+}
+
+func (s *Session) Leave(ctx context.Context) error {
+	return s.lease.stop(ctx)
+}
+
+func (p *Presence) Members(ctx context.Context, room string) ([]Member, error) {
+	keys := presenceKeys(room)
+	ids, err := membersScript.Run(ctx, p.client, keys).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list room %v: %w", room, err)
+	}
+	if len(ids) == 0 {
+		return []Member{}, nil
+	}
+
+	values, err := p.client.HMGet(ctx, keys[1], ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata for room %v: %w", room, err)
+	}
+	members := make([]Member, 0, len(ids))
+	for i, id := range ids {
+		member := Member{ID: id}
+		if data, ok := values[i].(string); ok {
+			json.Unmarshal([]byte(data), &member.Metadata)
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// Watch streams presence changes in room until ctx is done. Watchers also sweep members
+// whose heartbeat has lapsed, so expiry is only announced while someone is watching.
+func (p *Presence) Watch(ctx context.Context, room string) (<-chan PresenceEvent, error) {
+	sub := p.client.Subscribe(ctx, presenceChannel(room))
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("failed to watch room %v: %w", room, err)
+	}
+
+	events := make(chan PresenceEvent, 100)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+
+		sweepTicker := time.NewTicker(p.ttl / 2)
+		defer sweepTicker.Stop()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sweepTicker.C:
+				if err := sweepScript.Run(ctx, p.client, presenceKeys(room), presenceChannel(room)).Err(); err != nil && ctx.Err() == nil {
+					slog.WarnContext(ctx, "failed to sweep room", "room", room, "error", err)
+				}
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				eventType, member, found := strings.Cut(msg.Payload, ":")
+				if !found {
+					continue
+				}
+				select {
+				case events <- PresenceEvent{Room: room, Member: member, Type: eventType}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+func presenceKeys(room string) []string {
+	return []string{"presence:{" + room + "}", "presence:{" + room + "}:meta"}
+}
+
+func presenceChannel(room string) string {
+	return "presence:{" + room + "}:events"
+}
@@ -0,0 +1,78 @@
+package redisutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresenceJoinAndLeave(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	presence := NewPresence(client, time.Second)
+
+	events, err := presence.Watch(ctx, "lobby")
+	assert.NoError(t, err)
+
+	session, err := presence.Join(ctx, "lobby", "alice", map[string]string{"name": "Alice"})
+	assert.NoError(t, err)
+	assert.Equal(t, PresenceEvent{Room: "lobby", Member: "alice", Type: PresenceJoin}, <-events)
+
+	members, err := presence.Members(ctx, "lobby")
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{{ID: "alice", Metadata: map[string]string{"name": "Alice"}}}, members)
+
+	assert.NoError(t, session.Leave(ctx))
+	assert.Equal(t, PresenceEvent{Room: "lobby", Member: "alice", Type: PresenceLeave}, <-events)
+
+	members, err = presence.Members(ctx, "lobby")
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+}
+
+func TestPresenceSetMetadata(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	presence := NewPresence(client, time.Second)
+
+	events, err := presence.Watch(ctx, "lobby")
+	assert.NoError(t, err)
+	session, err := presence.Join(ctx, "lobby", "alice", map[string]string{"name": "Alice"})
+	assert.NoError(t, err)
+	assert.Equal(t, PresenceEvent{Room: "lobby", Member: "alice", Type: PresenceJoin}, <-events)
+
+	assert.NoError(t, session.SetMetadata(ctx, map[string]string{"name": "Al"}))
+	assert.Equal(t, PresenceEvent{Room: "lobby", Member: "alice", Type: PresenceUpdate}, <-events)
+	members, err := presence.Members(ctx, "lobby")
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{{ID: "alice", Metadata: map[string]string{"name": "Al"}}}, members)
+
+	// leaving doesn't leave metadata behind to be found by a later join
+	assert.NoError(t, session.Leave(ctx))
+	assert.ErrorIs(t, session.SetMetadata(ctx, map[string]string{"name": "Alice"}), ErrLeaseLost)
+	assert.Zero(t, client.HLen(ctx, "presence:{lobby}:meta").Val())
+}
+
+func TestPresenceExpiresMissedHeartbeats(t *testing.T) {
+	server, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	presence := NewPresence(client, 100*time.Millisecond)
+
+	events, err := presence.Watch(ctx, "lobby")
+	assert.NoError(t, err)
+
+	// a member left behind by a replica that died without leaving
+	server.ZAdd("presence:{lobby}", float64(time.Now().Add(-time.Minute).UnixMilli()), "bob")
+
+	select {
+	case event := <-events:
+		assert.Equal(t, PresenceEvent{Room: "lobby", Member: "bob", Type: PresenceExpire}, event)
+	case <-time.After(time.Second):
+		t.Fatal("expiry not announced")
+	}
+}
@@ -2,44 +2,64 @@ package redisutil
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
-	"time"
+	"sort"
 
 	"github.com/redis/go-redis/v9"
 	"gopkg.in/yaml.v3"
 )
 
 type RedisConfig struct {
-	Host string `yaml:"host"`
-	Port string `yaml:"port"`
+	Host               string `yaml:"host"`
+	Port               string `yaml:"port"`
+	Username           string `yaml:"username"`
+	Password           string `yaml:"password"`
+	DB                 int    `yaml:"db"`
+	TLS                bool   `yaml:"tls"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	// MasterName switches to sentinel mode, with Host and Port addressing the sentinels
+	MasterName       string `yaml:"masterName"`
+	SentinelUsername string `yaml:"sentinelUsername"`
+	SentinelPassword string `yaml:"sentinelPassword"`
 }
 
-var Set func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-var Get func(ctx context.Context, key string) *redis.StringCmd
-var Scan func(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
-var Del func(ctx context.Context, keys ...string) *redis.IntCmd
+// Client wraps a single node, cluster or sentinel backed redis.UniversalClient so the whole
+// go-redis command surface is available regardless of deployment.
+type Client struct {
+	redis.UniversalClient
+}
 
-func Start(ctx context.Context, config map[string]RedisConfig) error {
-	var err error
-	if len(config) == 1 {
-		for _, v := range config {
-			err = startSingle(ctx, v)
-		}
-	} else {
-		err = startCluster(ctx, config)
+// New connects to redis and pings every node before returning. A single config entry
+// connects to one node, several entries connect to a cluster and any entry with a
+// MasterName connects through sentinel.
+func New(ctx context.Context, config map[string]RedisConfig) (*Client, error) {
+	opts, err := universalOptions(config)
+	if err != nil {
+		return nil, err
 	}
 
-	if err != nil {
-		return err
+	slog.Info("initializing redis", "addrs", opts.Addrs, "masterName", opts.MasterName)
+	client := &Client{UniversalClient: redis.NewUniversalClient(opts)}
+	if err = client.ping(ctx); err != nil {
+		client.Close()
+		return nil, err
 	}
-	return nil
+	return client, nil
+}
+
+// NewFromClient wraps an existing go-redis client, for instance one pointed at miniredis in tests.
+func NewFromClient(rdb redis.UniversalClient) *Client {
+	return &Client{UniversalClient: rdb}
 }
 
 func ParseRedisConfig(config map[string]string) (map[string]RedisConfig, error) {
 	redis := make(map[string]RedisConfig, len(config))
-	var redisConfigValue RedisConfig
 	for k, v := range config {
+		var redisConfigValue RedisConfig
 		err := yaml.Unmarshal([]byte(v), &redisConfigValue)
 		if err != nil {
 			return nil, fmt.Errorf("could not unmarshal build config %v: %v", k, err)
@@ -49,36 +69,53 @@ func ParseRedisConfig(config map[string]string) (map[string]RedisConfig, error)
 	return redis, nil
 }
 
-func startCluster(ctx context.Context, config map[string]RedisConfig) error {
-	addrs := make([]string, len(config))
-	for _, v := range config {
-		addrs = append(addrs, v.Host+":"+v.Port)
+func universalOptions(config map[string]RedisConfig) (*redis.UniversalOptions, error) {
+	if len(config) == 0 {
+		return nil, fmt.Errorf("no redis config provided")
 	}
-	slog.Info("initializing redis", "addrs", addrs)
-	rdb := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs: addrs,
-	})
-	Set = rdb.Set
-	Get = rdb.Get
-	Scan = rdb.Scan
-	Del = rdb.Del
 
-	err := rdb.ForEachShard(ctx, ping)
-	if err != nil {
-		return err
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
 	}
-	return nil
+	sort.Strings(keys)
+
+	addrs := make([]string, 0, len(config))
+	for _, k := range keys {
+		addrs = append(addrs, config[k].Host+":"+config[k].Port)
+	}
+
+	// connection settings are shared by every node so they are taken from the first entry
+	first := config[keys[0]]
+	opts := &redis.UniversalOptions{
+		Addrs:            addrs,
+		Username:         first.Username,
+		Password:         first.Password,
+		DB:               first.DB,
+		MasterName:       first.MasterName,
+		SentinelUsername: first.SentinelUsername,
+		SentinelPassword: first.SentinelPassword,
+	}
+	if first.TLS {
+		opts.TLSConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: first.InsecureSkipVerify,
+		}
+	}
+	if len(addrs) > 1 && opts.MasterName == "" && opts.DB != 0 {
+		return nil, fmt.Errorf("redis cluster does not support selecting db %v", opts.DB)
+	}
+	return opts, nil
 }
 
-func startSingle(ctx context.Context, config RedisConfig) error {
-	rdb := redis.NewClient(&redis.Options{Addr: config.Host + ":" + config.Port})
-	Set = rdb.Set
-	Get = rdb.Get
-	Scan = rdb.Scan
-	Del = rdb.Del
-	err := ping(ctx, rdb)
-	if err != nil {
-		return err
+func (c *Client) ping(ctx context.Context) error {
+	if cluster, ok := c.UniversalClient.(*redis.ClusterClient); ok {
+		return cluster.ForEachShard(ctx, ping)
+	}
+	status := c.Ping(ctx)
+	slog.Info(fmt.Sprintf("pinging redis: %v", status.String()))
+	if status.Err() != nil {
+		return fmt.Errorf("failed to ping redis: %w", status.Err())
 	}
 	return nil
 }
@@ -94,3 +131,9 @@ func ping(ctx context.Context, shard *redis.Client) error {
 	}
 	return nil
 }
+
+func randomID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
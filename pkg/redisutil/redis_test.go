@@ -0,0 +1,147 @@
+package redisutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func startMiniredis(t *testing.T) (*miniredis.Miniredis, *Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client, err := New(context.Background(), map[string]RedisConfig{
+		"redis": {Host: server.Host(), Port: server.Port()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func TestClientCommands(t *testing.T) {
+	server, client := startMiniredis(t)
+	ctx := context.Background()
+
+	assert.NoError(t, client.Set(ctx, "key", "value", time.Minute).Err())
+	value, err := client.Get(ctx, "key").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.NoError(t, client.HSet(ctx, "hash", "field", "1").Err())
+	count, err := client.HIncrBy(ctx, "hash", "field", 2).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+
+	server.FastForward(2 * time.Minute)
+	assert.False(t, server.Exists("key"))
+}
+
+func TestNewFailsWithoutServer(t *testing.T) {
+	server := miniredis.RunT(t)
+	host, port := server.Host(), server.Port()
+	server.Close()
+
+	_, err := New(context.Background(), map[string]RedisConfig{"redis": {Host: host, Port: port}})
+	assert.Error(t, err)
+}
+
+func TestUniversalOptions(t *testing.T) {
+	opts, err := universalOptions(map[string]RedisConfig{
+		"b": {Host: "redis-b", Port: "6379", Password: "secret", TLS: true},
+		"a": {Host: "redis-a", Port: "6379", Password: "secret", TLS: true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"redis-a:6379", "redis-b:6379"}, opts.Addrs)
+	assert.Equal(t, "secret", opts.Password)
+	assert.NotNil(t, opts.TLSConfig)
+
+	opts, err = universalOptions(map[string]RedisConfig{
+		"sentinel": {Host: "sentinel", Port: "26379", MasterName: "mymaster", DB: 2},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "mymaster", opts.MasterName)
+	assert.Equal(t, 2, opts.DB)
+
+	_, err = universalOptions(map[string]RedisConfig{})
+	assert.Error(t, err)
+}
+
+func TestParseRedisConfig(t *testing.T) {
+	config, err := ParseRedisConfig(map[string]string{
+		"primary": "host: redis\nport: \"6379\"\npassword: secret\ndb: 1\n",
+		"replica": "host: replica\nport: \"6380\"\n",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, RedisConfig{Host: "redis", Port: "6379", Password: "secret", DB: 1}, config["primary"])
+	assert.Equal(t, RedisConfig{Host: "replica", Port: "6380"}, config["replica"])
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	server, client := startMiniredis(t)
+	ctx := context.Background()
+	store := NewIdempotencyStore(client)
+
+	stored, reserved, err := store.Reserve(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Nil(t, stored)
+
+	stored, reserved, err = store.Reserve(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Nil(t, stored)
+
+	assert.NoError(t, store.Extend(ctx, "key", time.Hour))
+	assert.Equal(t, time.Hour, server.TTL(idempotencyPrefix+"key"))
+
+	assert.NoError(t, store.Save(ctx, "key", []byte("response"), time.Minute))
+	stored, reserved, err = store.Reserve(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, []byte("response"), stored)
+
+	assert.NoError(t, store.Extend(ctx, "key", time.Hour))
+	assert.Equal(t, time.Minute, server.TTL(idempotencyPrefix+"key"))
+}
+
+func TestIdempotencyStoreReservesExpiredKey(t *testing.T) {
+	server, client := startMiniredis(t)
+	ctx := context.Background()
+	store := NewIdempotencyStore(client)
+
+	_, reserved, err := store.Reserve(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	server.FastForward(time.Minute)
+	stored, reserved, err := store.Reserve(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Nil(t, stored)
+	assert.Equal(t, time.Minute, server.TTL(idempotencyPrefix+"key"))
+}
+
+func TestBackplane(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string, 2)
+	for range 2 {
+		backplane := NewBackplane(client, "websocket")
+		assert.NoError(t, backplane.Subscribe(ctx, func(data []byte) { received <- string(data) }))
+	}
+	assert.NoError(t, NewBackplane(client, "websocket").Publish(ctx, []byte("push")))
+	for range 2 {
+		select {
+		case data := <-received:
+			assert.Equal(t, "push", data)
+		case <-time.After(time.Second):
+			t.Fatal("push not relayed")
+		}
+	}
+}
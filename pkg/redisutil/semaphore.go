@@ -0,0 +1,99 @@
+package redisutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Holders are kept in a sorted set scored by lease expiry so crashed holders age out
+var (
+	acquireSemaphoreScript = redis.NewScript(`
+local now = redis.call("TIME")
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", nowMs)
+if redis.call("ZCARD", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("ZADD", KEYS[1], nowMs + tonumber(ARGV[3]), ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	return 1
+end
+return 0`)
+	extendSemaphoreScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+local now = redis.call("TIME")
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+redis.call("ZADD", KEYS[1], "XX", nowMs + tonumber(ARGV[2]), ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1`)
+)
+
+// Semaphore allows up to limit concurrent holders of name across replicas
+type Semaphore struct {
+	client *Client
+	key    string
+	limit  int
+	config LockConfig
+}
+
+type Permit struct {
+	lease *lease
+}
+
+func NewSemaphore(client *Client, name string, limit int, config LockConfig) *Semaphore {
+	if config.TTL <= 0 {
+		config.TTL = 30 * time.Second
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 100 * time.Millisecond
+	}
+	return &Semaphore{client: client, key: "semaphore:{" + name + "}", limit: limit, config: config}
+}
+
+func (s *Semaphore) Acquire(ctx context.Context) (*Permit, error) {
+	for {
+		permit, err := s.TryAcquire(ctx)
+		if !errors.Is(err, ErrNotAcquired) {
+			return permit, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.config.RetryInterval):
+		}
+	}
+}
+
+func (s *Semaphore) TryAcquire(ctx context.Context) (*Permit, error) {
+	id := randomID()
+	ttl := s.config.TTL.Milliseconds()
+	result, err := acquireSemaphoreScript.Run(ctx, s.client, []string{s.key}, id, s.limit, ttl).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if result == 0 {
+		return nil, fmt.Errorf("semaphore %v: %w", s.key, ErrNotAcquired)
+	}
+
+	permit := &Permit{}
+	permit.lease = startLease(ctx, s.config.TTL, func(ctx context.Context) bool {
+		result, err := extendSemaphoreScript.Run(ctx, s.client, []string{s.key}, id, ttl).Int64()
+		return err == nil && result == 1
+	}, func(ctx context.Context) {
+		s.client.ZRem(ctx, s.key, id)
+	})
+	return permit, nil
+}
+
+// Context is cancelled once the permit is released or its lease is lost
+func (p *Permit) Context() context.Context {
+	return p.lease.ctx
+}
+
+func (p *Permit) Release(ctx context.Context) error {
+	return p.lease.stop(ctx)
+}
@@ -0,0 +1,303 @@
+package redisutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dataField       = "data"
+	attributePrefix = "attr:"
+)
+
+type StreamConfig struct {
+	Stream      string `yaml:"stream"`
+	Group       string `yaml:"group"`
+	Consumer    string `yaml:"consumer"`
+	Concurrency int    `yaml:"concurrency"`
+	BatchSize   int64  `yaml:"batchSize"`
+	// MaxLen approximately trims the stream when publishing, zero keeps everything
+	MaxLen int64 `yaml:"maxLen"`
+	// Messages delivered more than MaxDeliveries times are moved to DeadLetter
+	MaxDeliveries int64  `yaml:"maxDeliveries"`
+	DeadLetter    string `yaml:"deadLetter"`
+	// Messages left unacknowledged for ClaimIdle are redelivered, including those held by
+	// consumers that have gone away
+	ClaimIdle time.Duration `yaml:"claimIdle"`
+	Block     time.Duration `yaml:"block"`
+}
+
+type StreamMessage struct {
+	ID              string
+	Data            []byte
+	Attributes      map[string]string
+	DeliveryAttempt int64
+}
+
+func (c StreamConfig) withDefaults() StreamConfig {
+	if c.Consumer == "" {
+		c.Consumer, _ = os.Hostname()
+	}
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	if c.BatchSize < 1 {
+		c.BatchSize = 10
+	}
+	if c.MaxDeliveries < 1 {
+		c.MaxDeliveries = 5
+	}
+	if c.DeadLetter == "" {
+		c.DeadLetter = c.Stream + ":dead"
+	}
+	if c.ClaimIdle <= 0 {
+		c.ClaimIdle = 30 * time.Second
+	}
+	if c.Block <= 0 {
+		c.Block = 5 * time.Second
+	}
+	return c
+}
+
+func (c *Client) PublishStream(ctx context.Context, config StreamConfig, data []byte, attributes map[string]string) (string, error) {
+	values := make(map[string]any, len(attributes)+1)
+	values[dataField] = data
+	for k, v := range attributes {
+		values[attributePrefix+k] = v
+	}
+
+	args := &redis.XAddArgs{Stream: config.Stream, Values: values}
+	if config.MaxLen > 0 {
+		args.MaxLen = config.MaxLen
+		args.Approx = true
+	}
+	return c.XAdd(ctx, args).Result()
+}
+
+// SubscribeStream consumes config.Stream as part of config.Group until ctx is done. Messages are
+// acknowledged when handler returns nil; otherwise they stay pending and are redelivered
+// once ClaimIdle has passed, until MaxDeliveries moves them to the dead-letter stream.
+// The returned channel is closed once ctx is done and every in-flight handler has returned.
+func (c *Client) SubscribeStream(ctx context.Context, config StreamConfig, handler func(context.Context, *StreamMessage) error) (<-chan struct{}, error) {
+	config = config.withDefaults()
+
+	err := c.XGroupCreateMkStream(ctx, config.Stream, config.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("failed to create group %v on stream %v: %v", config.Group, config.Stream, err)
+	}
+
+	messages := make(chan *StreamMessage, config.BatchSize)
+	var wg sync.WaitGroup
+	for range config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range messages {
+				// buffered messages are left pending for reclaiming rather than handled with a
+				// cancelled context
+				if ctx.Err() != nil {
+					return
+				}
+				c.handle(ctx, config, msg, handler)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wg.Wait()
+	}()
+
+	go func() {
+		defer close(messages)
+		claimTicker := time.NewTicker(config.ClaimIdle)
+		defer claimTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-claimTicker.C:
+				c.reclaim(ctx, config, messages)
+			default:
+				c.read(ctx, config, messages)
+			}
+		}
+	}()
+
+	slog.Info(fmt.Sprintf("subscribed to stream [%v] as group [%v]", config.Stream, config.Group), "consumer", config.Consumer)
+	return done, nil
+}
+
+func (c *Client) read(ctx context.Context, config StreamConfig, messages chan<- *StreamMessage) {
+	streams, err := c.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    config.Group,
+		Consumer: config.Consumer,
+		Streams:  []string{config.Stream, ">"},
+		Count:    config.BatchSize,
+		Block:    config.Block,
+	}).Result()
+	if err != nil {
+		if err != redis.Nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "failed to read stream", "stream", config.Stream, "error", err)
+			time.Sleep(time.Second)
+		}
+		return
+	}
+
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			select {
+			case messages <- toStreamMessage(msg, 1):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) reclaim(ctx context.Context, config StreamConfig, messages chan<- *StreamMessage) {
+	start := "0-0"
+	for {
+		claimed, next, err := c.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   config.Stream,
+			Group:    config.Group,
+			Consumer: config.Consumer,
+			MinIdle:  config.ClaimIdle,
+			Start:    start,
+			Count:    config.BatchSize,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "failed to reclaim pending messages", "stream", config.Stream, "error", err)
+			}
+			return
+		}
+		if len(claimed) == 0 {
+			return
+		}
+
+		deliveries, err := c.deliveryCounts(ctx, config, claimed)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to read delivery counts", "stream", config.Stream, "error", err)
+			return
+		}
+
+		for _, msg := range claimed {
+			count, ok := deliveries[msg.ID]
+			if !ok {
+				slog.ErrorContext(ctx, "claimed stream message is no longer pending", "stream", config.Stream, "messageID", msg.ID)
+				continue
+			}
+			streamMessage := toStreamMessage(msg, count)
+			if streamMessage.DeliveryAttempt > config.MaxDeliveries {
+				c.deadLetter(ctx, config, msg)
+				continue
+			}
+			select {
+			case messages <- streamMessage:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if next == "0-0" {
+			return
+		}
+		start = next
+	}
+}
+
+// deliveryCounts looks up each claimed message on its own, as other messages pending in the
+// same ID range would use up the count of a range query
+func (c *Client) deliveryCounts(ctx context.Context, config StreamConfig, claimed []redis.XMessage) (map[string]int64, error) {
+	cmds := make([]*redis.XPendingExtCmd, len(claimed))
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, msg := range claimed {
+			cmds[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: config.Stream,
+				Group:  config.Group,
+				Start:  msg.ID,
+				End:    msg.ID,
+				Count:  1,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(map[string]int64, len(claimed))
+	for _, cmd := range cmds {
+		for _, p := range cmd.Val() {
+			deliveries[p.ID] = p.RetryCount
+		}
+	}
+	return deliveries, nil
+}
+
+func (c *Client) handle(ctx context.Context, config StreamConfig, msg *StreamMessage, handler func(context.Context, *StreamMessage) error) {
+	args := []any{"stream", config.Stream, "messageID", msg.ID, "deliveryAttempt", msg.DeliveryAttempt}
+	var err error
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		err = handler(ctx, msg)
+	}()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to handle stream message: "+err.Error(), args...)
+		return
+	}
+
+	// the handler succeeded, so ack even if the subscription was cancelled meanwhile
+	if err = c.XAck(context.WithoutCancel(ctx), config.Stream, config.Group, msg.ID).Err(); err != nil {
+		slog.ErrorContext(ctx, "failed to ack stream message: "+err.Error(), args...)
+	}
+}
+
+func (c *Client) deadLetter(ctx context.Context, config StreamConfig, msg redis.XMessage) {
+	values := make(map[string]any, len(msg.Values)+1)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values[attributePrefix+"originalId"] = msg.ID
+
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: config.DeadLetter, Values: values})
+		pipe.XAck(ctx, config.Stream, config.Group, msg.ID)
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to dead-letter stream message", "stream", config.Stream, "messageID", msg.ID, "error", err)
+		return
+	}
+	slog.WarnContext(ctx, "moved stream message to dead-letter stream", "stream", config.Stream, "messageID", msg.ID, "deadLetter", config.DeadLetter)
+}
+
+func toStreamMessage(msg redis.XMessage, deliveryAttempt int64) *StreamMessage {
+	streamMessage := &StreamMessage{
+		ID:              msg.ID,
+		Attributes:      make(map[string]string),
+		DeliveryAttempt: deliveryAttempt,
+	}
+	for k, v := range msg.Values {
+		value, _ := v.(string)
+		if k == dataField {
+			streamMessage.Data = []byte(value)
+		} else if attribute, ok := strings.CutPrefix(k, attributePrefix); ok {
+			streamMessage.Attributes[attribute] = value
+		}
+	}
+	return streamMessage
+}
@@ -0,0 +1,162 @@
+package redisutil
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSubscribeAcksHandledMessages(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := StreamConfig{Stream: "events", Group: "workers", Concurrency: 2, Block: 50 * time.Millisecond}
+	received := make(chan *StreamMessage, 1)
+	_, err := client.SubscribeStream(ctx, config, func(ctx context.Context, msg *StreamMessage) error {
+		received <- msg
+		return nil
+	})
+	assert.NoError(t, err)
+
+	_, err = client.PublishStream(ctx, config, []byte("hello"), map[string]string{"type": "greeting"})
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", string(msg.Data))
+		assert.Equal(t, "greeting", msg.Attributes["type"])
+		assert.Equal(t, int64(1), msg.DeliveryAttempt)
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	assert.Eventually(t, func() bool {
+		pending, err := client.XPending(ctx, "events", "workers").Result()
+		return err == nil && pending.Count == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStreamFailedMessagesAreDeadLettered(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := StreamConfig{
+		Stream:        "events",
+		Group:         "workers",
+		MaxDeliveries: 2,
+		ClaimIdle:     20 * time.Millisecond,
+		Block:         10 * time.Millisecond,
+	}
+	var attempts atomic.Int32
+	_, err := client.SubscribeStream(ctx, config, func(ctx context.Context, msg *StreamMessage) error {
+		attempts.Add(1)
+		return errors.New("failed")
+	})
+	assert.NoError(t, err)
+
+	id, err := client.PublishStream(ctx, config, []byte("poison"), nil)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		dead, err := client.XRange(ctx, "events:dead", "-", "+").Result()
+		return err == nil && len(dead) == 1 && dead[0].Values["attr:originalId"] == id
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), attempts.Load())
+}
+
+func TestStreamSubscriptionDrainsHandlers(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := StreamConfig{Stream: "events", Group: "workers", Block: 10 * time.Millisecond}
+	// both messages are read in one batch, so the second waits in the channel
+	_, err := client.PublishStream(ctx, config, []byte("slow"), nil)
+	assert.NoError(t, err)
+	buffered, err := client.PublishStream(ctx, config, []byte("buffered"), nil)
+	assert.NoError(t, err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled atomic.Int32
+	done, err := client.SubscribeStream(ctx, config, func(ctx context.Context, msg *StreamMessage) error {
+		handled.Add(1)
+		close(started)
+		<-release
+		return nil
+	})
+	assert.NoError(t, err)
+
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+		t.Fatal("subscription finished while a handler was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("subscription didn't finish after the handler returned")
+	}
+
+	// the running handler is acked despite the cancellation and the buffered message is
+	// left pending
+	assert.Equal(t, int32(1), handled.Load())
+	pending, err := client.XPendingExt(context.Background(), &redis.XPendingExtArgs{
+		Stream: "events", Group: "workers", Start: "-", End: "+", Count: 10,
+	}).Result()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, buffered, pending[0].ID)
+	}
+}
+
+func TestStreamReclaimCountsEachClaimedMessage(t *testing.T) {
+	_, client := startMiniredis(t)
+	ctx := context.Background()
+	config := StreamConfig{
+		Stream:        "events",
+		Group:         "workers",
+		Consumer:      "worker",
+		MaxDeliveries: 1,
+		ClaimIdle:     20 * time.Millisecond,
+	}.withDefaults()
+	assert.NoError(t, client.XGroupCreateMkStream(ctx, config.Stream, config.Group, "0").Err())
+	var ids []string
+	for _, data := range []string{"first", "busy", "last"} {
+		id, err := client.PublishStream(ctx, config, []byte(data), nil)
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+	_, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: config.Group, Consumer: config.Consumer, Streams: []string{config.Stream, ">"},
+	}).Result()
+	assert.NoError(t, err)
+
+	// the middle message is pending for the same consumer but too recently delivered to claim
+	time.Sleep(2 * config.ClaimIdle)
+	assert.NoError(t, client.XClaim(ctx, &redis.XClaimArgs{
+		Stream: config.Stream, Group: config.Group, Consumer: config.Consumer, Messages: []string{ids[1]},
+	}).Err())
+
+	messages := make(chan *StreamMessage, 10)
+	client.reclaim(ctx, config, messages)
+	assert.Empty(t, messages)
+	dead, err := client.XRange(ctx, config.DeadLetter, "-", "+").Result()
+	assert.NoError(t, err)
+	var deadIDs []any
+	for _, msg := range dead {
+		deadIDs = append(deadIDs, msg.Values["attr:originalId"])
+	}
+	assert.Equal(t, []any{ids[0], ids[2]}, deadIDs)
+}
@@ -0,0 +1,136 @@
+package websocketutil
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Backplane carries pushes between hub replicas so that a Push on any replica reaches
+// connections on all of them. redisutil.Backplane and pubsubutil.Backplane implement it.
+type Backplane interface {
+	Publish(ctx context.Context, data []byte) error
+	// Subscribe starts calling handler for every published message, including this
+	// replica's own, until ctx is done
+	Subscribe(ctx context.Context, handler func(data []byte)) error
+}
+
+// dedupeWindow is how many relayed message IDs a hub remembers to drop redeliveries
+const dedupeWindow = 10000
+
+// envelope is a push relayed over the backplane. Sequence numbers are assigned by each
+// replica, so resuming with LastSequenceHeader only works when clients reconnect to the
+// same replica.
+type envelope struct {
+	ID           string    `json:"id"`
+	Replica      string    `json:"replica"`
+	Path         string    `json:"path,omitempty"`
+	Topic        string    `json:"topic,omitempty"`
+	ConnectionID uuid.UUID `json:"connectionId,omitzero"`
+	Principal    string    `json:"principal,omitempty"`
+	Data         []byte    `json:"data"`
+	// Variants are the encodings of a typed push, keyed by codec subprotocol
+	Variants map[string][]byte `json:"variants,omitempty"`
+}
+
+// recentIDs is a fixed size set of the last IDs added
+type recentIDs struct {
+	mux   sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+// add reports whether id was new
+func (r *recentIDs) add(id string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.ids[id]; ok {
+		return false
+	}
+	delete(r.ids, r.order[r.next])
+	r.order[r.next] = id
+	r.next = (r.next + 1) % len(r.order)
+	r.ids[id] = struct{}{}
+	return true
+}
+
+func (h *Hub) startBackplane(ctx context.Context) {
+	h.relayed = make(chan envelope, 1000)
+	h.seen = newRecentIDs(dedupeWindow)
+
+	if err := h.config.Backplane.Subscribe(ctx, h.receive); err != nil {
+		slog.Error("failed to subscribe to the websocket backplane, pushes will only reach local connections", "error", err)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-h.relayed:
+				data, err := json.Marshal(e)
+				if err == nil {
+					err = h.config.Backplane.Publish(ctx, data)
+				}
+				if err != nil {
+					slog.Error("failed to relay push to the websocket backplane", "error", err, "path", e.Path, "topic", e.Topic)
+				}
+			}
+		}
+	}()
+}
+
+// relay queues a local push for the other replicas. Without wait the push isn't relayed
+// when the queue is full.
+func (h *Hub) relay(e envelope, wait bool) {
+	if h.config.Backplane == nil {
+		return
+	}
+	e.ID = uuid.NewString()
+	e.Replica = h.config.ReplicaID
+	if wait {
+		select {
+		case h.relayed <- e:
+		case <-h.done:
+		}
+		return
+	}
+	select {
+	case h.relayed <- e:
+	default:
+		slog.Warn("websocket backplane queue full, push not relayed", "path", e.Path, "topic", e.Topic)
+	}
+}
+
+// receive delivers pushes from other replicas to local connections
+func (h *Hub) receive(data []byte) {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		slog.Error("invalid message on the websocket backplane", "error", err)
+		return
+	}
+	if e.Replica == h.config.ReplicaID || !h.seen.add(e.ID) {
+		return
+	}
+	f := frame{data: e.Data, variants: e.Variants}
+	switch {
+	case e.ConnectionID != uuid.Nil:
+		h.sendTo(e.ConnectionID, f)
+	case e.Principal != "":
+		h.sendToPrincipal(e.Principal, e.Path, f)
+	case e.Topic != "":
+		h.pushTopic(f, e.Topic, true)
+	default:
+		h.push(f, e.Path, true)
+	}
+}
@@ -0,0 +1,140 @@
+package websocketutil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// bus is an in-process Backplane that delivers every message twice to check de-duplication
+type bus struct {
+	mux      sync.Mutex
+	handlers []func([]byte)
+}
+
+func (b *bus) Publish(ctx context.Context, data []byte) error {
+	b.mux.Lock()
+	handlers := append([]func([]byte){}, b.handlers...)
+	b.mux.Unlock()
+	for _, handler := range handlers {
+		handler(data)
+		handler(data)
+	}
+	return nil
+}
+
+func (b *bus) Subscribe(ctx context.Context, handler func([]byte)) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func startReplica(t *testing.T, ctx context.Context, backplane Backplane) (*Hub, string) {
+	t.Helper()
+	hub := NewHub(ctx, HubConfig{Backplane: backplane})
+	mux := http.NewServeMux()
+	hub.ServeOutbound(mux, "/feed")
+	hub.ServeTopics(mux, "/topics")
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return hub, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func awaitConnections(t *testing.T, hub *Hub, n int) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		hub.rwMux.RLock()
+		defer hub.rwMux.RUnlock()
+		return len(hub.connections) == n
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func readString(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBackplaneReachesEveryReplicaOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backplane := &bus{}
+	hubA, urlA := startReplica(t, ctx, backplane)
+	hubB, urlB := startReplica(t, ctx, backplane)
+
+	connA := dial(t, urlA+"/feed")
+	connB := dial(t, urlB+"/feed")
+	awaitConnections(t, hubA, 1)
+	awaitConnections(t, hubB, 1)
+
+	hubA.Push([]byte("first"), "/feed")
+	hubB.Push([]byte("second"), "/feed")
+	for _, conn := range []*websocket.Conn{connA, connB} {
+		received := []string{readString(t, conn), readString(t, conn)}
+		assert.ElementsMatch(t, []string{"first", "second"}, received)
+	}
+
+	hubA.Push([]byte("third"), "/feed")
+	assert.Equal(t, "third", readString(t, connA))
+	assert.Equal(t, "third", readString(t, connB))
+}
+
+func TestBackplaneRelaysTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backplane := &bus{}
+	hubA, _ := startReplica(t, ctx, backplane)
+	_, urlB := startReplica(t, ctx, backplane)
+
+	conn := dialTopics(t, urlB+"/topics", TopicsJSONSubprotocol)
+	sendFrame(t, conn, TopicFrame{Op: OpSubscribe, ID: 1, Topic: "news"})
+	assert.Equal(t, OpAck, readFrame(t, conn).Op)
+
+	delivered, _ := hubA.TryPushTopic([]byte(`"extra"`), "news")
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, TopicFrame{Op: OpMessage, Topic: "news", Data: []byte(`"extra"`)}, readFrame(t, conn))
+}
+
+func TestBackplaneKeepsTopicVariants(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, _ := startReplica(t, ctx, &bus{})
+
+	conn := &connection{id: uuid.New(), queue: make(chan frame, 1), closed: make(chan struct{})}
+	hub.rwMux.Lock()
+	hub.topics["news"] = map[uuid.UUID]*connection{conn.id: conn}
+	hub.rwMux.Unlock()
+
+	variants := map[string][]byte{"json": []byte(`"extra"`)}
+	data, err := json.Marshal(envelope{ID: "1", Replica: "other", Topic: "news", Variants: variants})
+	assert.NoError(t, err)
+	hub.receive(data)
+
+	f := <-conn.queue
+	assert.Equal(t, "news", f.topic)
+	assert.Equal(t, variants, f.variants)
+}
+
+func TestRecentIDs(t *testing.T) {
+	recent := newRecentIDs(2)
+	assert.True(t, recent.add("a"))
+	assert.False(t, recent.add("a"))
+	assert.True(t, recent.add("b"))
+	assert.True(t, recent.add("c"))
+	assert.True(t, recent.add("a"))
+	assert.False(t, recent.add("c"))
+}
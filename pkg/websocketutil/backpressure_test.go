@@ -0,0 +1,116 @@
+package websocketutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// stalledConnection registers a connection whose writer never drains the queue
+func stalledConnection(t *testing.T, hub *Hub) *connection {
+	t.Helper()
+	conn := &connection{
+		id:       uuid.New(),
+		path:     "/feed",
+		writable: true,
+		queue:    make(chan frame, hub.config.QueueSize),
+		closed:   make(chan struct{}),
+	}
+	assert.True(t, hub.register(conn, 0, false))
+	return conn
+}
+
+func drain(conn *connection) []string {
+	var messages []string
+	for {
+		select {
+		case msg := <-conn.queue:
+			messages = append(messages, string(msg.data))
+		default:
+			return messages
+		}
+	}
+}
+
+func TestDropOldestKeepsNewestMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{QueueSize: 2, SlowConsumer: DropOldest})
+	conn := stalledConnection(t, hub)
+
+	for _, msg := range []string{"1", "2", "3"} {
+		delivered, dropped := hub.TryPush([]byte(msg), "/feed")
+		assert.Equal(t, 1, delivered)
+		assert.Equal(t, 0, dropped)
+	}
+	assert.Equal(t, []string{"2", "3"}, drain(conn))
+}
+
+func TestDropNewestReportsDrops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{QueueSize: 1, SlowConsumer: DropNewest})
+	slow := stalledConnection(t, hub)
+
+	hub.TryPush([]byte("1"), "/feed")
+	delivered, dropped := hub.TryPush([]byte("2"), "/feed")
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, []string{"1"}, drain(slow))
+}
+
+func TestDisconnectClosesSlowConsumerOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{QueueSize: 1, SlowConsumer: Disconnect})
+	slow := stalledConnection(t, hub)
+	fast := stalledConnection(t, hub)
+
+	hub.TryPush([]byte("1"), "/feed")
+	drain(fast)
+	delivered, dropped := hub.TryPush([]byte("2"), "/feed")
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, 1, dropped)
+
+	select {
+	case <-slow.closed:
+		assert.Equal(t, websocket.CloseTryAgainLater, slow.closeCode)
+	default:
+		t.Fatal("slow consumer was not disconnected")
+	}
+	select {
+	case <-fast.closed:
+		t.Fatal("fast consumer was disconnected")
+	default:
+	}
+}
+
+func TestBlockWaitsForRoomThenDrops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{QueueSize: 1, SlowConsumer: Block, BlockTimeout: 50 * time.Millisecond})
+	conn := stalledConnection(t, hub)
+	hub.Push([]byte("1"), "/feed")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-conn.queue
+	}()
+	start := time.Now()
+	hub.Push([]byte("2"), "/feed")
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	start = time.Now()
+	delivered, dropped := hub.push(frame{data: []byte("3")}, "/feed", true)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 1, dropped)
+
+	delivered, dropped = hub.TryPush([]byte("4"), "/feed")
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 1, dropped)
+}
@@ -0,0 +1,280 @@
+package websocketutil
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type ConnectionState int
+
+const (
+	Connecting ConnectionState = iota
+	Connected
+	Disconnected
+	Closed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	}
+	return "closed"
+}
+
+type StateEvent struct {
+	State ConnectionState
+	// Attempt counts the dials since the last successful connection
+	Attempt int
+	Err     error
+}
+
+var ErrBufferFull = errors.New("outbound buffer full")
+
+type ClientConfig struct {
+	Dialer
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BufferSize bounds the outbound messages held while disconnected
+	BufferSize int
+}
+
+// Client keeps a websocket connected, redialling with exponential backoff. When the server
+// speaks SequenceSubprotocol it resumes after the last message received; otherwise messages
+// pushed while disconnected are lost.
+type Client struct {
+	url      string
+	config   ClientConfig
+	inbound  chan []byte
+	outbound chan []byte
+	states   chan StateEvent
+	done     chan struct{}
+
+	mux     sync.Mutex
+	state   ConnectionState
+	lastSeq uint64
+	resume  bool
+	// pending holds a message whose write failed so it's retried on the next connection
+	pending []byte
+}
+
+// Connect starts a Client that runs until ctx is done
+func Connect(ctx context.Context, url string, config ClientConfig) *Client {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 30 * time.Second
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = 100
+	}
+	config.Keepalive = config.Keepalive.withDefaults()
+
+	c := &Client{
+		url:      url,
+		config:   config,
+		inbound:  make(chan []byte, 100),
+		outbound: make(chan []byte, config.BufferSize),
+		states:   make(chan StateEvent, 16),
+		done:     make(chan struct{}),
+	}
+	go c.run(ctx)
+	return c
+}
+
+// Inbound is closed once the client has stopped
+func (c *Client) Inbound() <-chan []byte {
+	return c.inbound
+}
+
+// States reports connection state changes and is closed after the Closed event.
+// Events are dropped if nobody is reading.
+func (c *Client) States() <-chan StateEvent {
+	return c.states
+}
+
+func (c *Client) State() ConnectionState {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.state
+}
+
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Send queues message for the current or next connection without blocking
+func (c *Client) Send(message []byte) error {
+	select {
+	case <-c.done:
+		return errors.New("client closed")
+	default:
+	}
+	select {
+	case c.outbound <- message:
+		return nil
+	default:
+		return ErrBufferFull
+	}
+}
+
+func (c *Client) setState(event StateEvent) {
+	c.mux.Lock()
+	c.state = event.State
+	c.mux.Unlock()
+	select {
+	case c.states <- event:
+	default:
+	}
+}
+
+func (c *Client) run(ctx context.Context) {
+	defer close(c.done)
+	defer close(c.states)
+	defer close(c.inbound)
+	defer c.setState(StateEvent{State: Closed})
+
+	attempt := 0
+	backoff := c.config.MinBackoff
+	for {
+		attempt++
+		c.setState(StateEvent{State: Connecting, Attempt: attempt})
+		conn, err := c.dial(ctx)
+		if err == nil {
+			attempt = 0
+			backoff = c.config.MinBackoff
+			c.setState(StateEvent{State: Connected})
+			err = c.serve(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		c.setState(StateEvent{State: Disconnected, Attempt: attempt, Err: err})
+		slog.InfoContext(ctx, "websocket disconnected", "url", c.url, "error", err)
+
+		// full jitter keeps a fleet of clients from reconnecting in lockstep
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rand.N(backoff) + time.Millisecond):
+		}
+		backoff = min(backoff*2, c.config.MaxBackoff)
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	header := http.Header{}
+	for k, v := range c.config.Header {
+		header[k] = v
+	}
+	c.mux.Lock()
+	if c.resume {
+		header.Set(LastSequenceHeader, strconv.FormatUint(c.lastSeq, 10))
+	}
+	c.mux.Unlock()
+
+	dialer := c.config.websocketDialer()
+	dialer.Subprotocols = []string{SequenceSubprotocol}
+	conn, _, err := dialer.DialContext(ctx, c.url, header)
+	return conn, err
+}
+
+// serve runs one connection until it fails or ctx is done
+func (c *Client) serve(ctx context.Context, conn *websocket.Conn) error {
+	// wait for the writer so a failed message is back in pending before the next connection
+	writerDone := make(chan struct{})
+	defer func() { <-writerDone }()
+	defer conn.Close()
+	keepalive := c.config.Keepalive
+	keepalive.configure(conn)
+	sequenced := conn.Subprotocol() == SequenceSubprotocol
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	closeWith := func(code int, text string) {
+		stopOnce.Do(func() {
+			keepalive.close(conn, code, text)
+			close(stop)
+		})
+	}
+	defer closeWith(websocket.CloseNormalClosure, "goodbye")
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeWith(websocket.CloseNormalClosure, "goodbye")
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	go keepalive.ping(conn, stop)
+	go func() {
+		defer close(writerDone)
+		c.write(conn, stop)
+	}()
+
+	for {
+		_, message, err := keepalive.read(conn)
+		if err != nil {
+			closeWith(closeReason(err))
+			return err
+		}
+		if sequenced {
+			seq, data, err := decodeSequenced(message)
+			if err != nil {
+				closeWith(websocket.CloseProtocolError, err.Error())
+				return err
+			}
+			if seq > 0 {
+				c.mux.Lock()
+				c.lastSeq = seq
+				c.resume = true
+				c.mux.Unlock()
+			}
+			message = data
+		}
+		select {
+		case c.inbound <- message:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) write(conn *websocket.Conn, stop <-chan struct{}) {
+	keepalive := c.config.Keepalive
+	for {
+		c.mux.Lock()
+		msg := c.pending
+		c.pending = nil
+		c.mux.Unlock()
+
+		if msg == nil {
+			select {
+			case msg = <-c.outbound:
+			case <-stop:
+				return
+			}
+		}
+		if err := keepalive.write(conn, websocket.BinaryMessage, msg); err != nil {
+			c.mux.Lock()
+			c.pending = msg
+			c.mux.Unlock()
+			// closing makes the reader fail and serve return
+			conn.Close()
+			return
+		}
+	}
+}
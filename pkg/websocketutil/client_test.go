@@ -0,0 +1,108 @@
+package websocketutil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, inbound <-chan []byte) string {
+	t.Helper()
+	select {
+	case msg, ok := <-inbound:
+		if !ok {
+			t.Fatal("inbound closed")
+		}
+		return string(msg)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+	return ""
+}
+
+func awaitState(t *testing.T, client *Client, state ConnectionState) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return client.State() == state }, 2*time.Second, 5*time.Millisecond)
+}
+
+// disconnectAll closes every registered connection from the server side
+func disconnectAll(hub *Hub) {
+	hub.rwMux.RLock()
+	defer hub.rwMux.RUnlock()
+	for _, regPath := range hub.registrations {
+		for _, conn := range regPath {
+			conn.close(websocket.CloseServiceRestart, "restart")
+		}
+	}
+}
+
+func TestClientResumesAfterReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{ReplaySize: 10})
+	mux := http.NewServeMux()
+	hub.ServeOutbound(mux, "/feed")
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := Connect(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/feed", ClientConfig{MinBackoff: 10 * time.Millisecond})
+	awaitState(t, client, Connected)
+	assert.Eventually(t, func() bool {
+		delivered, _ := hub.TryPush([]byte("1"), "/feed")
+		return delivered == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "1", receive(t, client.Inbound()))
+
+	disconnectAll(hub)
+	hub.Push([]byte("2"), "/feed")
+	hub.Push([]byte("3"), "/feed")
+
+	assert.Equal(t, "2", receive(t, client.Inbound()))
+	assert.Equal(t, "3", receive(t, client.Inbound()))
+	awaitState(t, client, Connected)
+
+	var states []ConnectionState
+	for len(client.States()) > 0 {
+		states = append(states, (<-client.States()).State)
+	}
+	assert.Contains(t, states, Disconnected)
+}
+
+func TestClientBuffersWhileDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := Connect(ctx, "ws://"+listener.Addr().String()+"/chat", ClientConfig{MinBackoff: 10 * time.Millisecond})
+	assert.NoError(t, client.Send([]byte("queued")))
+
+	hub := NewHub(ctx, HubConfig{})
+	mux := http.NewServeMux()
+	inbound := hub.ServeDuplex(mux, "/chat")
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	select {
+	case conn := <-inbound:
+		assert.Equal(t, "queued", receive(t, conn.Inbound))
+	case <-time.After(2 * time.Second):
+		t.Fatal("client never connected")
+	}
+
+	cancel()
+	<-client.Done()
+	assert.Equal(t, Closed, client.State())
+}
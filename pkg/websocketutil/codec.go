@@ -0,0 +1,267 @@
+package websocketutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts values to and from websocket messages. A typed endpoint offers its codecs
+// as subprotocols and each connection uses the one its client negotiated.
+type Codec interface {
+	Subprotocol() string
+	// MessageType is websocket.TextMessage or websocket.BinaryMessage
+	MessageType() int
+	Marshal(value any) ([]byte, error)
+	// Unmarshal decodes data into value, which is a pointer
+	Unmarshal(data []byte, value any) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Subprotocol() string { return "json" }
+func (JSONCodec) MessageType() int    { return websocket.TextMessage }
+
+func (JSONCodec) Marshal(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec) Unmarshal(data []byte, value any) error {
+	return json.Unmarshal(data, value)
+}
+
+// ProtobufCodec encodes generated message pointers such as *types.Message
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Subprotocol() string { return "protobuf" }
+func (ProtobufCodec) MessageType() int    { return websocket.BinaryMessage }
+
+func (ProtobufCodec) Marshal(value any) ([]byte, error) {
+	msg, ok := value.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", value)
+	}
+	return proto.Marshal(msg)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, value any) error {
+	target := reflect.ValueOf(value)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("%T is not a pointer", value)
+	}
+	msg, ok := target.Elem().Interface().(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", target.Elem().Interface())
+	}
+	msg = msg.ProtoReflect().New().Interface()
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return err
+	}
+	target.Elem().Set(reflect.ValueOf(msg))
+	return nil
+}
+
+// TextCodec sends strings and byte slices unchanged as text messages
+type TextCodec struct{}
+
+func (TextCodec) Subprotocol() string { return "text" }
+func (TextCodec) MessageType() int    { return websocket.TextMessage }
+
+func (TextCodec) Marshal(value any) ([]byte, error) {
+	return marshalRaw(value)
+}
+
+func (TextCodec) Unmarshal(data []byte, value any) error {
+	return unmarshalRaw(data, value)
+}
+
+// BinaryCodec sends strings and byte slices unchanged as binary messages, like the untyped
+// hub methods do
+type BinaryCodec struct{}
+
+func (BinaryCodec) Subprotocol() string { return "binary" }
+func (BinaryCodec) MessageType() int    { return websocket.BinaryMessage }
+
+func (BinaryCodec) Marshal(value any) ([]byte, error) {
+	return marshalRaw(value)
+}
+
+func (BinaryCodec) Unmarshal(data []byte, value any) error {
+	return unmarshalRaw(data, value)
+}
+
+func marshalRaw(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("%T is not a string or []byte", value)
+}
+
+func unmarshalRaw(data []byte, value any) error {
+	switch v := value.(type) {
+	case *[]byte:
+		*v = data
+	case *string:
+		*v = string(data)
+	default:
+		return fmt.Errorf("%T is not a *string or *[]byte", value)
+	}
+	return nil
+}
+
+func negotiated(codecs []Codec, subprotocol string) Codec {
+	for _, codec := range codecs {
+		if codec.Subprotocol() == subprotocol {
+			return codec
+		}
+	}
+	return codecs[0]
+}
+
+// TypedInbound is InboundChan with messages decoded by the connection's codec
+type TypedInbound[In any] struct {
+	ConnectionID uuid.UUID
+	Principal    string
+	Codec        Codec
+	Inbound      <-chan In
+}
+
+// Endpoint sends values to the connections of a typed endpoint, encoded with each
+// connection's codec
+type Endpoint[Out any] struct {
+	hub    *Hub
+	path   string
+	codecs []Codec
+}
+
+// ServeInbound is Hub.ServeInbound with messages decoded by the negotiated codec. Codecs
+// default to JSONCodec. Connections that send undecodable messages are closed with
+// CloseUnsupportedData.
+func ServeInbound[In any](h *Hub, mux *http.ServeMux, path string, codecs ...Codec) <-chan TypedInbound[In] {
+	codecs = defaultCodecs(codecs)
+	return decodeInbound[In](h, h.serve(mux, path, inboundWS, codecs))
+}
+
+// ServeDuplex is Hub.ServeDuplex with typed messages in both directions
+func ServeDuplex[In, Out any](h *Hub, mux *http.ServeMux, path string, codecs ...Codec) (<-chan TypedInbound[In], *Endpoint[Out]) {
+	codecs = defaultCodecs(codecs)
+	inbound := decodeInbound[In](h, h.serve(mux, path, duplexWS, codecs))
+	return inbound, &Endpoint[Out]{hub: h, path: path, codecs: codecs}
+}
+
+// ServeOutbound is Hub.ServeOutbound with typed messages
+func ServeOutbound[Out any](h *Hub, mux *http.ServeMux, path string, codecs ...Codec) *Endpoint[Out] {
+	codecs = defaultCodecs(codecs)
+	h.serve(mux, path, outboundWS, codecs)
+	return &Endpoint[Out]{hub: h, path: path, codecs: codecs}
+}
+
+func defaultCodecs(codecs []Codec) []Codec {
+	if len(codecs) == 0 {
+		return []Codec{JSONCodec{}}
+	}
+	return codecs
+}
+
+func decodeInbound[In any](h *Hub, raw <-chan InboundChan) <-chan TypedInbound[In] {
+	output := make(chan TypedInbound[In], 100)
+	go func() {
+		defer close(output)
+		for conn := range raw {
+			inbound := make(chan In, 100)
+			output <- TypedInbound[In]{
+				ConnectionID: conn.ConnectionID,
+				Principal:    conn.Principal,
+				Codec:        conn.Codec,
+				Inbound:      inbound,
+			}
+			go func() {
+				defer close(inbound)
+				for data := range conn.Inbound {
+					var value In
+					if err := conn.Codec.Unmarshal(data, &value); err != nil {
+						slog.Info("failed to decode websocket message", "error", err, "connectionID", conn.ConnectionID)
+						h.disconnect(conn.ConnectionID, websocket.CloseUnsupportedData, "undecodable message")
+						continue
+					}
+					inbound <- value
+				}
+			}()
+		}
+	}()
+	return output
+}
+
+// encode marshals value once per codec so each connection gets its own encoding
+func (e *Endpoint[Out]) encode(value Out) (frame, error) {
+	f := frame{variants: make(map[string][]byte, len(e.codecs))}
+	for _, codec := range e.codecs {
+		data, err := codec.Marshal(value)
+		if err != nil {
+			return frame{}, fmt.Errorf("failed to encode %T as %v: %w", value, codec.Subprotocol(), err)
+		}
+		f.variants[codec.Subprotocol()] = data
+	}
+	return f, nil
+}
+
+// Push is Hub.Push for a typed value
+func (e *Endpoint[Out]) Push(value Out) error {
+	f, err := e.encode(value)
+	if err != nil {
+		return err
+	}
+	e.hub.relay(envelope{Path: e.path, Variants: f.variants}, true)
+	_, dropped := e.hub.push(f, e.path, true)
+	if dropped > 0 {
+		slog.Debug("dropped messages for slow consumers", "path", e.path, "dropped", dropped)
+	}
+	return nil
+}
+
+// TryPush is Hub.TryPush for a typed value
+func (e *Endpoint[Out]) TryPush(value Out) (delivered, dropped int, err error) {
+	f, err := e.encode(value)
+	if err != nil {
+		return 0, 0, err
+	}
+	e.hub.relay(envelope{Path: e.path, Variants: f.variants}, false)
+	delivered, dropped = e.hub.push(f, e.path, false)
+	return delivered, dropped, nil
+}
+
+// SendTo is Hub.SendTo for a typed value
+func (e *Endpoint[Out]) SendTo(id uuid.UUID, value Out) error {
+	f, err := e.encode(value)
+	if err != nil {
+		return err
+	}
+	err = e.hub.sendTo(id, f)
+	if err != ErrUnknownConnection || e.hub.config.Backplane == nil {
+		return err
+	}
+	e.hub.relay(envelope{ConnectionID: id, Variants: f.variants}, true)
+	return nil
+}
+
+// SendToPrincipal is Hub.SendToPrincipal for a typed value, limited to this endpoint
+func (e *Endpoint[Out]) SendToPrincipal(principal string, value Out) (int, error) {
+	if principal == "" {
+		return 0, nil
+	}
+	f, err := e.encode(value)
+	if err != nil {
+		return 0, err
+	}
+	e.hub.relay(envelope{Principal: principal, Path: e.path, Variants: f.variants}, true)
+	return e.hub.sendToPrincipal(principal, e.path, f), nil
+}
@@ -0,0 +1,121 @@
+package websocketutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type chatIn struct {
+	Text string `json:"text"`
+}
+
+type chatOut struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+}
+
+func dialSubprotocol(t *testing.T, url string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) (int, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messageType, data
+}
+
+func TestTypedDuplex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{})
+	mux := http.NewServeMux()
+	inbound, endpoint := ServeDuplex[chatIn, chatOut](hub, mux, "/chat")
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conn := dialSubprotocol(t, "ws"+strings.TrimPrefix(server.URL, "http")+"/chat", "json")
+	assert.Equal(t, "json", conn.Subprotocol())
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"text":"hello"}`)))
+
+	registered := <-inbound
+	assert.Equal(t, JSONCodec{}, registered.Codec)
+	assert.Equal(t, chatIn{Text: "hello"}, <-registered.Inbound)
+
+	assert.NoError(t, endpoint.SendTo(registered.ConnectionID, chatOut{From: "server", Text: "hi"}))
+	messageType, data := readMessage(t, conn)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.JSONEq(t, `{"from":"server","text":"hi"}`, string(data))
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseUnsupportedData))
+	_, open := <-registered.Inbound
+	assert.False(t, open)
+}
+
+func TestNegotiatedCodecs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{})
+	mux := http.NewServeMux()
+	endpoint := ServeOutbound[*wrapperspb.StringValue](hub, mux, "/feed", JSONCodec{}, ProtobufCodec{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/feed"
+
+	protoConn := dialSubprotocol(t, url, "protobuf")
+	assert.Equal(t, "protobuf", protoConn.Subprotocol())
+	defaultConn := dialSubprotocol(t, url)
+	awaitConnections(t, hub, 2)
+
+	assert.NoError(t, endpoint.Push(wrapperspb.String("update")))
+
+	messageType, data := readMessage(t, protoConn)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	var value wrapperspb.StringValue
+	assert.NoError(t, proto.Unmarshal(data, &value))
+	assert.Equal(t, "update", value.GetValue())
+
+	messageType, data = readMessage(t, defaultConn)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.JSONEq(t, `{"value":"update"}`, string(data))
+}
+
+func TestCodecs(t *testing.T) {
+	var text string
+	assert.NoError(t, TextCodec{}.Unmarshal([]byte("plain"), &text))
+	assert.Equal(t, "plain", text)
+	data, err := BinaryCodec{}.Marshal("raw")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("raw"), data)
+	_, err = TextCodec{}.Marshal(42)
+	assert.Error(t, err)
+
+	data, err = ProtobufCodec{}.Marshal(wrapperspb.Int64(7))
+	assert.NoError(t, err)
+	var value *wrapperspb.Int64Value
+	assert.NoError(t, ProtobufCodec{}.Unmarshal(data, &value))
+	assert.Equal(t, int64(7), value.GetValue())
+	_, err = ProtobufCodec{}.Marshal(chatOut{})
+	assert.Error(t, err)
+}
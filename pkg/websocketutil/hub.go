@@ -0,0 +1,550 @@
+package websocketutil
+
+import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy decides what happens when a connection's send queue is full
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room
+	DropOldest SlowConsumerPolicy = iota
+	// DropNewest discards the message being pushed
+	DropNewest
+	// Disconnect closes the connection with CloseTryAgainLater
+	Disconnect
+	// Block makes Push wait up to BlockTimeout for room before dropping the message
+	Block
+)
+
+type HubConfig struct {
+	// Origin restricts upgrades to a single Origin header, empty accepts any origin
+	Origin       string
+	QueueSize    int
+	SlowConsumer SlowConsumerPolicy
+	BlockTimeout time.Duration
+	Keepalive    Keepalive
+	// ReplaySize is how many messages per path are kept for clients resuming with
+	// LastSequenceHeader. Zero disables resuming.
+	ReplaySize int
+	// Backplane relays pushes to the hubs on other replicas, which must use the same one.
+	// ReplicaID tags this hub's pushes so it ignores them coming back and defaults to a
+	// random ID.
+	Backplane Backplane
+	ReplicaID string
+	// Authenticate is called before upgrading and returns the principal the connection
+	// acts for. An error rejects the connection with 401 Unauthorized.
+	Authenticate func(r *http.Request) (string, error)
+	// Compression accepts permessage-deflate from clients that offer it, compressing at
+	// CompressionLevel, which defaults to flate.BestSpeed
+	Compression      bool
+	CompressionLevel int
+	// ServerSentEvents lets plain HTTP clients read outbound paths as an event stream
+	ServerSentEvents bool
+}
+
+// Hub fans pushed messages out to the websocket connections registered on a path. Each hub
+// has its own upgrader and registrations, so several can run in one process.
+type Hub struct {
+	config        HubConfig
+	upgrader      websocket.Upgrader
+	rwMux         sync.RWMutex
+	registrations map[string]map[uuid.UUID]*connection
+	topics        map[string]map[uuid.UUID]*connection
+	connections   map[uuid.UUID]*connection
+	sequences     map[string]uint64
+	replay        map[string][]frame
+	relayed       chan envelope
+	seen          *recentIDs
+	done          chan struct{}
+}
+
+// frame is a pushed message with its per-path sequence number, or the topic it was pushed
+// to. Control frames are already encoded replies on topic connections. Typed pushes carry
+// the message encoded for each codec of the endpoint, keyed by subprotocol.
+type frame struct {
+	seq      uint64
+	topic    string
+	data     []byte
+	variants map[string][]byte
+	control  bool
+}
+
+// framing is how queued frames are written to a connection
+const (
+	rawFraming = iota
+	jsonTopicFraming
+	binaryTopicFraming
+)
+
+// connection is the send side of a websocket. Its queue is never closed so that pushes
+// racing with a disconnect can't panic; closed signals the writer to stop instead.
+type connection struct {
+	id          uuid.UUID
+	path        string
+	principal   string
+	remoteAddr  string
+	header      http.Header
+	connectedAt time.Time
+	// writable is false for inbound only connections, which have no writer
+	writable  bool
+	queue     chan frame
+	sequenced bool
+	// codec is the negotiated codec on typed endpoints
+	codec   Codec
+	framing int
+	// topics is guarded by the hub's rwMux
+	topics    map[string]struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+}
+
+func (c *connection) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.closed)
+	})
+}
+
+// NewHub starts a hub that runs until ctx is done
+func NewHub(ctx context.Context, config HubConfig) *Hub {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = time.Second
+	}
+	config.Keepalive = config.Keepalive.withDefaults()
+	if config.CompressionLevel == 0 {
+		config.CompressionLevel = flate.BestSpeed
+	}
+	if config.ReplicaID == "" {
+		config.ReplicaID = uuid.NewString()
+	}
+	h := &Hub{
+		config:        config,
+		registrations: make(map[string]map[uuid.UUID]*connection),
+		topics:        make(map[string]map[uuid.UUID]*connection),
+		connections:   make(map[uuid.UUID]*connection),
+		sequences:     make(map[string]uint64),
+		replay:        make(map[string][]frame),
+		done:          make(chan struct{}),
+	}
+	if len(config.Origin) > 0 {
+		h.upgrader = websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return r.Header.Get("Origin") == config.Origin
+			},
+		}
+	} else {
+		h.upgrader = websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		}
+	}
+	h.upgrader.Subprotocols = []string{SequenceSubprotocol}
+	h.upgrader.EnableCompression = config.Compression
+	if config.Backplane != nil {
+		h.startBackplane(ctx)
+	}
+
+	go func() {
+		defer close(h.done)
+		<-ctx.Done()
+		h.rwMux.Lock()
+		defer h.rwMux.Unlock()
+		for _, conn := range h.connections {
+			conn.close(websocket.CloseNormalClosure, "goodbye")
+		}
+		h.registrations = nil
+		h.topics = nil
+		h.connections = nil
+	}()
+	return h
+}
+
+// Done is closed once the hub has stopped and told every connection to close
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+func (h *Hub) ServeInbound(mux *http.ServeMux, path string) <-chan InboundChan {
+	return h.serve(mux, path, inboundWS, nil)
+}
+
+func (h *Hub) ServeDuplex(mux *http.ServeMux, path string) <-chan InboundChan {
+	return h.serve(mux, path, duplexWS, nil)
+}
+
+func (h *Hub) ServeOutbound(mux *http.ServeMux, path string) {
+	h.serve(mux, path, outboundWS, nil)
+}
+
+// Push queues message for every outbound and duplex connection on path, applying the
+// hub's SlowConsumerPolicy to connections whose queue is full. With a Backplane the
+// message is also pushed on every other replica.
+func (h *Hub) Push(message []byte, path string) {
+	h.relay(envelope{Path: path, Data: message}, true)
+	_, dropped := h.push(frame{data: message}, path, true)
+	if dropped > 0 {
+		slog.Debug("dropped messages for slow consumers", "path", path, "dropped", dropped)
+	}
+}
+
+// TryPush is Push without ever waiting, even under the Block policy. It reports how many
+// local connections the message was queued for and how many missed it.
+func (h *Hub) TryPush(message []byte, path string) (delivered, dropped int) {
+	h.relay(envelope{Path: path, Data: message}, false)
+	return h.push(frame{data: message}, path, false)
+}
+
+func (h *Hub) push(f frame, path string, wait bool) (delivered, dropped int) {
+	// sequencing, buffering and taking the snapshot together means a connection that
+	// registers concurrently gets the message exactly once, either replayed or pushed
+	h.rwMux.Lock()
+	if h.registrations == nil {
+		h.rwMux.Unlock()
+		return 0, 0
+	}
+	h.sequences[path]++
+	f.seq = h.sequences[path]
+	if h.config.ReplaySize > 0 {
+		replay := append(h.replay[path], f)
+		h.replay[path] = replay[max(0, len(replay)-h.config.ReplaySize):]
+	}
+	conns := snapshot(h.registrations[path])
+	h.rwMux.Unlock()
+	return h.deliver(conns, f, wait)
+}
+
+func snapshot(conns map[uuid.UUID]*connection) []*connection {
+	s := make([]*connection, 0, len(conns))
+	for _, conn := range conns {
+		s = append(s, conn)
+	}
+	return s
+}
+
+func (h *Hub) deliver(conns []*connection, f frame, wait bool) (delivered, dropped int) {
+	var blocked []*connection
+	for _, conn := range conns {
+		if h.enqueue(conn, f) {
+			delivered++
+		} else if wait && h.config.SlowConsumer == Block {
+			blocked = append(blocked, conn)
+		} else {
+			dropped++
+		}
+	}
+	if len(blocked) == 0 {
+		return delivered, dropped
+	}
+
+	// wait on the slow connections together so one doesn't delay the others
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	for _, conn := range blocked {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			timer := time.NewTimer(h.config.BlockTimeout)
+			defer timer.Stop()
+			ok := false
+			select {
+			case conn.queue <- f:
+				ok = true
+			case <-conn.closed:
+			case <-timer.C:
+			}
+			mux.Lock()
+			defer mux.Unlock()
+			if ok {
+				delivered++
+			} else {
+				dropped++
+			}
+		}()
+	}
+	wg.Wait()
+	return delivered, dropped
+}
+
+// enqueue applies the non-blocking part of the policy and reports whether message was queued
+func (h *Hub) enqueue(conn *connection, f frame) bool {
+	select {
+	case <-conn.closed:
+		return false
+	default:
+	}
+
+	select {
+	case conn.queue <- f:
+		return true
+	default:
+	}
+
+	switch h.config.SlowConsumer {
+	case DropOldest:
+		for {
+			select {
+			case conn.queue <- f:
+				return true
+			default:
+			}
+			select {
+			case <-conn.queue:
+			default:
+			}
+		}
+	case Disconnect:
+		slog.Info("disconnecting slow consumer", "connectionID", conn.id, "path", conn.path)
+		conn.close(websocket.CloseTryAgainLater, "too slow")
+	}
+	return false
+}
+
+// register adds conn to its path, or for topic connections only to the hub so it can
+// subscribe later. When resuming, buffered messages after since are queued first; if more
+// were missed than ReplaySize the client silently skips the gap.
+func (h *Hub) register(conn *connection, since uint64, resume bool) bool {
+	h.rwMux.Lock()
+	defer h.rwMux.Unlock()
+	if h.registrations == nil {
+		return false
+	}
+	h.connections[conn.id] = conn
+	if !conn.writable {
+		slog.Info("sender connected", "connectionID", conn.id, "path", conn.path)
+		return true
+	}
+	if conn.framing != rawFraming {
+		slog.Info("topic listener connected", "connectionID", conn.id, "path", conn.path)
+		return true
+	}
+	if _, ok := h.registrations[conn.path]; !ok {
+		h.registrations[conn.path] = make(map[uuid.UUID]*connection)
+	}
+	h.registrations[conn.path][conn.id] = conn
+	slog.Info("listener connected", "connectionID", conn.id, "path", conn.path)
+
+	if resume {
+		for _, f := range h.replay[conn.path] {
+			if f.seq > since {
+				h.enqueue(conn, f)
+			}
+		}
+	}
+	return true
+}
+
+func (h *Hub) unregister(conn *connection) {
+	h.rwMux.Lock()
+	defer h.rwMux.Unlock()
+	if h.registrations == nil {
+		return
+	}
+	delete(h.connections, conn.id)
+	if !conn.writable {
+		slog.Info("sender disconnected", "connectionID", conn.id, "path", conn.path)
+		return
+	}
+	if conn.framing != rawFraming {
+		for topic := range conn.topics {
+			h.removeSubscriber(conn, topic)
+		}
+		slog.Info("topic listener disconnected", "connectionID", conn.id, "path", conn.path)
+		return
+	}
+	delete(h.registrations[conn.path], conn.id)
+	if len(h.registrations[conn.path]) == 0 {
+		delete(h.registrations, conn.path)
+	}
+	slog.Info("listener disconnected", "connectionID", conn.id, "path", conn.path)
+}
+
+// serve handles raw connections when codecs is empty, otherwise connections negotiate one of
+// the codecs instead of the sequence subprotocol and get the first codec if they ask for none
+func (h *Hub) serve(mux *http.ServeMux, path string, wsType int, codecs []Codec) <-chan InboundChan {
+	output := make(chan InboundChan, 100)
+	keepalive := h.config.Keepalive
+	upgrader := h.upgrader
+	if len(codecs) > 0 {
+		upgrader.Subprotocols = make([]string, len(codecs))
+		for i, codec := range codecs {
+			upgrader.Subprotocols[i] = codec.Subprotocol()
+		}
+	}
+
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		connectionID := uuid.New()
+		args := []any{"connectionID", connectionID}
+		defer func() {
+			p := recover()
+			if p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), err.Error(), args...)
+			}
+		}()
+		slog.InfoContext(r.Context(), "recieved connection", args...)
+
+		principal, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if h.config.ServerSentEvents && wsType == outboundWS && !websocket.IsWebSocketUpgrade(r) {
+			err = h.serveEvents(w, r, h.newConnection(connectionID, r, principal), codecs)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			http.Error(w, "Could not upgrade to websocket", http.StatusInternalServerError)
+			return
+		}
+		defer ws.Close()
+		keepalive.configure(ws)
+		h.configureCompression(ws)
+
+		conn := h.newConnection(connectionID, r, principal)
+		conn.writable = wsType != inboundWS
+		conn.sequenced = len(codecs) == 0 && ws.Subprotocol() == SequenceSubprotocol
+		if len(codecs) > 0 {
+			conn.codec = negotiated(codecs, ws.Subprotocol())
+		}
+		since, resumeErr := strconv.ParseUint(r.Header.Get(LastSequenceHeader), 10, 64)
+		defer func() {
+			conn.close(websocket.CloseNormalClosure, "goodbye")
+			keepalive.close(ws, conn.closeCode, conn.closeText)
+		}()
+		if !h.register(conn, since, resumeErr == nil && conn.sequenced) {
+			return
+		}
+		defer h.unregister(conn)
+
+		// the reader closes the connection with a code describing why reading stopped
+		done := make(chan struct{})
+		var inbound chan []byte
+		if wsType != outboundWS {
+			inbound = make(chan []byte, 100)
+			output <- InboundChan{
+				ConnectionID: connectionID,
+				Principal:    principal,
+				Codec:        conn.codec,
+				Inbound:      inbound,
+			}
+		}
+		go func() {
+			defer close(done)
+			if inbound != nil {
+				defer close(inbound)
+			}
+			for {
+				_, message, err := keepalive.read(ws)
+				if err != nil {
+					if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+						slog.InfoContext(r.Context(), "websocket read failed", "error", err, "connectionID", connectionID)
+					}
+					conn.close(closeReason(err))
+					return
+				}
+				// Outbound websockets only need to detect if the client has disconnected
+				if inbound != nil {
+					inbound <- message
+				}
+			}
+		}()
+		go keepalive.ping(ws, conn.closed)
+
+		if wsType == inboundWS {
+			select {
+			case <-done:
+			case <-conn.closed:
+			}
+			return
+		}
+		h.write(r.Context(), ws, conn, done)
+	})
+	return output
+}
+
+func (h *Hub) configureCompression(ws *websocket.Conn) {
+	if !h.config.Compression {
+		return
+	}
+	if err := ws.SetCompressionLevel(h.config.CompressionLevel); err != nil {
+		slog.Warn("invalid websocket compression level", "error", err, "level", h.config.CompressionLevel)
+	}
+}
+
+// write sends queued frames until the connection is closed or its reader finishes
+func (h *Hub) write(ctx context.Context, ws *websocket.Conn, conn *connection, done <-chan struct{}) {
+	for {
+		select {
+		case f := <-conn.queue:
+			messageType, data, err := conn.encode(f)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to encode frame", "error", err, "connectionID", conn.id)
+				continue
+			}
+			if err = h.config.Keepalive.write(ws, messageType, data); err != nil {
+				slog.InfoContext(ctx, err.Error())
+				return
+			}
+		case <-conn.closed:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// encode turns a queued frame into a websocket message for this connection's framing
+func (c *connection) encode(f frame) (int, []byte, error) {
+	switch c.framing {
+	case jsonTopicFraming:
+		if f.control {
+			return websocket.TextMessage, f.data, nil
+		}
+		data, err := json.Marshal(TopicFrame{Op: OpMessage, Topic: f.topic, Data: f.data})
+		return websocket.TextMessage, data, err
+	case binaryTopicFraming:
+		if f.control {
+			return websocket.BinaryMessage, f.data, nil
+		}
+		data, err := TopicFrame{Op: OpMessage, Topic: f.topic, Data: f.data}.MarshalBinary()
+		return websocket.BinaryMessage, data, err
+	}
+	if c.codec != nil {
+		if data, ok := f.variants[c.codec.Subprotocol()]; ok {
+			return c.codec.MessageType(), data, nil
+		}
+	}
+	if f.variants != nil {
+		return 0, nil, fmt.Errorf("typed message has no encoding for this connection")
+	}
+	if c.codec != nil {
+		return c.codec.MessageType(), f.data, nil
+	}
+	if c.sequenced {
+		return websocket.BinaryMessage, encodeSequenced(f.seq, f.data), nil
+	}
+	return websocket.BinaryMessage, f.data, nil
+}
@@ -0,0 +1,87 @@
+package websocketutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func startHub(t *testing.T, ctx context.Context) (*Hub, string) {
+	t.Helper()
+	hub := NewHub(ctx, HubConfig{})
+	mux := http.NewServeMux()
+	hub.ServeOutbound(mux, "/feed")
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return hub, "ws" + strings.TrimPrefix(server.URL, "http") + "/feed"
+}
+
+func dial(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// pushUntilReceived retries because the connection registers with the hub asynchronously
+func pushUntilReceived(t *testing.T, hub *Hub, conn *websocket.Conn, message string) {
+	t.Helper()
+	received := make(chan string, 1)
+	go func() {
+		_, data, err := conn.ReadMessage()
+		if err == nil {
+			received <- string(data)
+		}
+	}()
+	for range 100 {
+		hub.Push([]byte(message), "/feed")
+		select {
+		case data := <-received:
+			assert.Equal(t, message, data)
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("message not received")
+}
+
+func TestHubsAreIndependent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, firstURL := startHub(t, ctx)
+	_, secondURL := startHub(t, ctx)
+	firstConn := dial(t, firstURL)
+	secondConn := dial(t, secondURL)
+
+	pushUntilReceived(t, first, firstConn, "hello")
+
+	secondConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := secondConn.ReadMessage()
+	assert.Error(t, err, "second hub should not receive pushes to the first")
+}
+
+func TestHubClosesConnectionsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hub, url := startHub(t, ctx)
+	conn := dial(t, url)
+	pushUntilReceived(t, hub, conn, "hello")
+
+	cancel()
+	<-hub.Done()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "unexpected error %v", err)
+
+	// pushing to a stopped hub must not block
+	hub.Push([]byte("late"), "/feed")
+}
@@ -0,0 +1,157 @@
+package websocketutil
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUnknownConnection is returned by SendTo when the connection isn't on this hub, or
+// only reads from its client, and there's no Backplane to try the other replicas
+var ErrUnknownConnection = errors.New("unknown websocket connection")
+
+// ErrMessageDropped is returned by SendTo when the SlowConsumerPolicy dropped the message
+var ErrMessageDropped = errors.New("websocket message dropped for slow consumer")
+
+// disconnect closes a local connection, reporting whether it was found
+func (h *Hub) disconnect(id uuid.UUID, code int, text string) bool {
+	h.rwMux.RLock()
+	conn, ok := h.connections[id]
+	h.rwMux.RUnlock()
+	if ok {
+		conn.close(code, text)
+	}
+	return ok
+}
+
+// ConnectionInfo describes a connection open on a hub
+type ConnectionInfo struct {
+	ID        uuid.UUID
+	Principal string
+	Path      string
+	// Topics is only set for ServeTopics connections
+	Topics      []string
+	RemoteAddr  string
+	Header      http.Header
+	ConnectedAt time.Time
+}
+
+func (h *Hub) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if h.config.Authenticate == nil {
+		return "", true
+	}
+	principal, err := h.config.Authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "websocket authentication failed", "error", err, "remoteAddr", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return principal, true
+}
+
+func (h *Hub) newConnection(id uuid.UUID, r *http.Request, principal string) *connection {
+	return &connection{
+		id:          id,
+		path:        r.URL.Path,
+		principal:   principal,
+		remoteAddr:  r.RemoteAddr,
+		header:      r.Header.Clone(),
+		connectedAt: time.Now(),
+		queue:       make(chan frame, h.config.QueueSize),
+		closed:      make(chan struct{}),
+	}
+}
+
+// info must be called with rwMux held because of the topics
+func (c *connection) info() ConnectionInfo {
+	info := ConnectionInfo{
+		ID:          c.id,
+		Principal:   c.principal,
+		Path:        c.path,
+		RemoteAddr:  c.remoteAddr,
+		Header:      c.header.Clone(),
+		ConnectedAt: c.connectedAt,
+	}
+	for topic := range c.topics {
+		info.Topics = append(info.Topics, topic)
+	}
+	slices.Sort(info.Topics)
+	return info
+}
+
+// Connections lists the connections open on this hub, not on other replicas
+func (h *Hub) Connections() []ConnectionInfo {
+	h.rwMux.RLock()
+	defer h.rwMux.RUnlock()
+	infos := make([]ConnectionInfo, 0, len(h.connections))
+	for _, conn := range h.connections {
+		infos = append(infos, conn.info())
+	}
+	slices.SortFunc(infos, func(a, b ConnectionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	return infos
+}
+
+func (h *Hub) Connection(id uuid.UUID) (ConnectionInfo, bool) {
+	h.rwMux.RLock()
+	defer h.rwMux.RUnlock()
+	conn, ok := h.connections[id]
+	if !ok {
+		return ConnectionInfo{}, false
+	}
+	return conn.info(), true
+}
+
+// SendTo queues message for a single connection, applying the SlowConsumerPolicy. When
+// the connection isn't on this hub the message is relayed over the Backplane, if there is
+// one, in case it's on another replica.
+func (h *Hub) SendTo(id uuid.UUID, message []byte) error {
+	err := h.sendTo(id, frame{data: message})
+	if err != ErrUnknownConnection || h.config.Backplane == nil {
+		return err
+	}
+	h.relay(envelope{ConnectionID: id, Data: message}, true)
+	return nil
+}
+
+// SendToPrincipal queues message for every connection of principal on every replica and
+// reports how many local connections it was queued for
+func (h *Hub) SendToPrincipal(principal string, message []byte) int {
+	if principal == "" {
+		return 0
+	}
+	h.relay(envelope{Principal: principal, Data: message}, true)
+	return h.sendToPrincipal(principal, "", frame{data: message})
+}
+
+func (h *Hub) sendTo(id uuid.UUID, f frame) error {
+	h.rwMux.RLock()
+	conn, ok := h.connections[id]
+	h.rwMux.RUnlock()
+	if !ok || !conn.writable {
+		return ErrUnknownConnection
+	}
+	if delivered, _ := h.deliver([]*connection{conn}, f, true); delivered == 0 {
+		return ErrMessageDropped
+	}
+	return nil
+}
+
+// sendToPrincipal only sends to connections on path, unless it's empty
+func (h *Hub) sendToPrincipal(principal, path string, f frame) int {
+	h.rwMux.RLock()
+	var conns []*connection
+	for _, conn := range h.connections {
+		if conn.principal == principal && conn.writable && (path == "" || conn.path == path) {
+			conns = append(conns, conn)
+		}
+	}
+	h.rwMux.RUnlock()
+	delivered, _ := h.deliver(conns, f, true)
+	return delivered
+}
@@ -0,0 +1,109 @@
+package websocketutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func startIdentityHub(t *testing.T, ctx context.Context) (*Hub, <-chan InboundChan, string) {
+	t.Helper()
+	hub := NewHub(ctx, HubConfig{
+		Authenticate: func(r *http.Request) (string, error) {
+			user := r.Header.Get("X-User")
+			if user == "" {
+				return "", fmt.Errorf("no user")
+			}
+			return user, nil
+		},
+	})
+	mux := http.NewServeMux()
+	inbound := hub.ServeDuplex(mux, "/chat")
+	hub.ServeOutbound(mux, "/feed")
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return hub, inbound, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialAs(t *testing.T, url, user string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-User": {user}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestAuthenticateRejectsConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, url := startIdentityHub(t, ctx)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/chat", nil)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestTargetedSends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, inbound, url := startIdentityHub(t, ctx)
+
+	aliceChat := dialAs(t, url+"/chat", "alice")
+	registered := <-inbound
+	assert.Equal(t, "alice", registered.Principal)
+	aliceFeed := dialAs(t, url+"/feed", "alice")
+	bobChat := dialAs(t, url+"/chat", "bob")
+	<-inbound
+	awaitConnections(t, hub, 3)
+
+	info, ok := hub.Connection(registered.ConnectionID)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", info.Principal)
+	assert.Equal(t, "/chat", info.Path)
+	assert.Equal(t, "alice", info.Header.Get("X-User"))
+	assert.NotEmpty(t, info.RemoteAddr)
+	assert.False(t, info.ConnectedAt.IsZero())
+
+	principals := map[string]int{}
+	for _, info := range hub.Connections() {
+		principals[info.Principal]++
+	}
+	assert.Equal(t, map[string]int{"alice": 2, "bob": 1}, principals)
+
+	assert.NoError(t, hub.SendTo(registered.ConnectionID, []byte("just you")))
+	assert.Equal(t, "just you", readString(t, aliceChat))
+
+	assert.Equal(t, 2, hub.SendToPrincipal("alice", []byte("all of alice")))
+	assert.Equal(t, "all of alice", readString(t, aliceChat))
+	assert.Equal(t, "all of alice", readString(t, aliceFeed))
+
+	assert.Equal(t, 1, hub.SendToPrincipal("bob", []byte("bob only")))
+	assert.Equal(t, "bob only", readString(t, bobChat))
+
+	assert.ErrorIs(t, hub.SendTo(uuid.New(), []byte("nobody")), ErrUnknownConnection)
+	assert.Equal(t, 0, hub.SendToPrincipal("carol", []byte("nobody")))
+}
+
+func TestSendToRelaysUnknownConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backplane := &bus{}
+	hubA, _ := startReplica(t, ctx, backplane)
+	hubB, urlB := startReplica(t, ctx, backplane)
+
+	conn := dial(t, urlB+"/feed")
+	awaitConnections(t, hubB, 1)
+	id := hubB.Connections()[0].ID
+
+	assert.NoError(t, hubA.SendTo(id, []byte("across replicas")))
+	assert.Equal(t, "across replicas", readString(t, conn))
+}
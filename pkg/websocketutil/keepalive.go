@@ -0,0 +1,113 @@
+package websocketutil
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseTimeout is sent when the peer stopped answering pings. It sits in the private range
+// so that clients can tell it apart from a normal closure or a server error.
+const CloseTimeout = 4408
+
+// Keepalive bounds how long a connection can sit idle or stalled. Zero fields use the
+// defaults from DefaultKeepalive.
+type Keepalive struct {
+	PingInterval time.Duration
+	// PongTimeout is how long a connection may go without a pong or any other frame
+	PongTimeout    time.Duration
+	WriteTimeout   time.Duration
+	MaxMessageSize int64
+}
+
+func DefaultKeepalive() Keepalive {
+	return Keepalive{
+		PingInterval:   30 * time.Second,
+		PongTimeout:    60 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxMessageSize: 1 << 20,
+	}
+}
+
+func (k Keepalive) withDefaults() Keepalive {
+	defaults := DefaultKeepalive()
+	if k.PingInterval <= 0 {
+		k.PingInterval = defaults.PingInterval
+	}
+	if k.PongTimeout <= 0 {
+		k.PongTimeout = max(defaults.PongTimeout, 2*k.PingInterval)
+	}
+	if k.WriteTimeout <= 0 {
+		k.WriteTimeout = defaults.WriteTimeout
+	}
+	if k.MaxMessageSize <= 0 {
+		k.MaxMessageSize = defaults.MaxMessageSize
+	}
+	return k
+}
+
+// configure sets the read limit and a read deadline that every received frame extends
+func (k Keepalive) configure(ws *websocket.Conn) {
+	ws.SetReadLimit(k.MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(k.PongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(k.PongTimeout))
+	})
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(k.PongTimeout))
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(k.WriteTimeout))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+}
+
+// read returns the next message and extends the read deadline
+func (k Keepalive) read(ws *websocket.Conn) (int, []byte, error) {
+	messageType, message, err := ws.ReadMessage()
+	if err == nil {
+		ws.SetReadDeadline(time.Now().Add(k.PongTimeout))
+	}
+	return messageType, message, err
+}
+
+func (k Keepalive) write(ws *websocket.Conn, messageType int, data []byte) error {
+	ws.SetWriteDeadline(time.Now().Add(k.WriteTimeout))
+	return ws.WriteMessage(messageType, data)
+}
+
+// ping sends pings until done is closed or a ping can't be written. WriteControl may be
+// called concurrently with the connection's other writer.
+func (k Keepalive) ping(ws *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(k.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(k.WriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (k Keepalive) close(ws *websocket.Conn, code int, text string) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(k.WriteTimeout))
+}
+
+// closeReason picks the close code to send after a read failed
+func closeReason(err error) (int, string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, "message too big"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseTimeout, "timeout"
+	}
+	return websocket.CloseNormalClosure, "goodbye"
+}
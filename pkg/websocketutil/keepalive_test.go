@@ -0,0 +1,93 @@
+package websocketutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func startKeepaliveHub(t *testing.T, keepalive Keepalive) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	hub := NewHub(ctx, HubConfig{Keepalive: keepalive})
+	mux := http.NewServeMux()
+	inbound := hub.ServeDuplex(mux, "/feed")
+	go func() {
+		for range inbound {
+		}
+	}()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/feed"
+}
+
+func TestUnresponsiveClientIsClosedWithTimeout(t *testing.T) {
+	url := startKeepaliveHub(t, Keepalive{PingInterval: 10 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	conn := dial(t, url)
+	// swallow pings without answering them
+	conn.SetPingHandler(func(string) error { return nil })
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, CloseTimeout), "unexpected error %v", err)
+}
+
+func TestResponsiveClientStaysConnected(t *testing.T) {
+	url := startKeepaliveHub(t, Keepalive{PingInterval: 10 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	conn := dial(t, url)
+
+	// reading processes pings and answers them with pongs
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err := conn.ReadMessage()
+	assert.False(t, websocket.IsCloseError(err, CloseTimeout), "unexpected close %v", err)
+}
+
+func TestOversizedMessageIsRejected(t *testing.T) {
+	url := startKeepaliveHub(t, Keepalive{MaxMessageSize: 16})
+	conn := dial(t, url)
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 64))))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "unexpected error %v", err)
+}
+
+func TestClientKeepsConnectionAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keepalive := Keepalive{PingInterval: 10 * time.Millisecond, PongTimeout: 50 * time.Millisecond}
+	hub := NewHub(ctx, HubConfig{Keepalive: keepalive})
+	mux := http.NewServeMux()
+	hub.ServeOutbound(mux, "/feed")
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dialer := &Dialer{Keepalive: keepalive}
+	inbound := dialer.Inbound(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/feed")
+
+	// outlive several pong timeouts before pushing
+	time.Sleep(200 * time.Millisecond)
+	deadline := time.After(time.Second)
+	for {
+		hub.Push([]byte("still here"), "/feed")
+		select {
+		case msg, ok := <-inbound:
+			assert.True(t, ok, "connection closed")
+			assert.Equal(t, "still here", string(msg))
+			return
+		case <-deadline:
+			t.Fatal("message not received")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
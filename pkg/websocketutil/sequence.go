@@ -0,0 +1,29 @@
+package websocketutil
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// SequenceSubprotocol prefixes every outbound frame with its 8 byte big-endian sequence
+	// number so that a reconnecting client can resume where it left off. Messages sent to a
+	// single connection or principal aren't replayed and carry sequence 0.
+	SequenceSubprotocol = "seq.v1"
+	// LastSequenceHeader is sent by a resuming client with the last sequence it received
+	LastSequenceHeader = "Last-Sequence"
+)
+
+func encodeSequenced(seq uint64, message []byte) []byte {
+	data := make([]byte, 8+len(message))
+	binary.BigEndian.PutUint64(data, seq)
+	copy(data[8:], message)
+	return data
+}
+
+func decodeSequenced(data []byte) (uint64, []byte, error) {
+	if len(data) < 8 {
+		return 0, nil, fmt.Errorf("sequenced frame too short: %d bytes", len(data))
+	}
+	return binary.BigEndian.Uint64(data), data[8:], nil
+}
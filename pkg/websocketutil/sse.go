@@ -0,0 +1,100 @@
+package websocketutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// LastEventIDHeader is sent by reconnecting event stream clients with the id of the last
+// event they received, which is the message's sequence number
+const LastEventIDHeader = "Last-Event-ID"
+
+// serveEvents streams an outbound path as server-sent events. Messages are split into data
+// lines on newlines, so binary messages are best kept off paths that SSE clients read. On
+// typed endpoints the first codec that writes text messages is used.
+func (h *Hub) serveEvents(w http.ResponseWriter, r *http.Request, conn *connection, codecs []Codec) error {
+	keepalive := h.config.Keepalive
+	controller := http.NewResponseController(w)
+	conn.writable = true
+	if len(codecs) > 0 {
+		conn.codec = codecs[0]
+		for _, codec := range codecs {
+			if codec.MessageType() == websocket.TextMessage {
+				conn.codec = codec
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return fmt.Errorf("event stream can't be flushed: %w", err)
+	}
+
+	since, resumeErr := strconv.ParseUint(r.Header.Get(LastEventIDHeader), 10, 64)
+	defer conn.close(websocket.CloseNormalClosure, "goodbye")
+	if !h.register(conn, since, resumeErr == nil) {
+		return nil
+	}
+	defer h.unregister(conn)
+
+	// comments keep proxies from timing out an idle stream and detect dead clients
+	ticker := time.NewTicker(keepalive.PingInterval)
+	defer ticker.Stop()
+	for {
+		var event []byte
+		select {
+		case f := <-conn.queue:
+			_, data, err := conn.encode(f)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "failed to encode event", "error", err, "connectionID", conn.id)
+				continue
+			}
+			event = encodeEvent(f.seq, data)
+		case <-ticker.C:
+			event = []byte(": ping\n\n")
+		case <-conn.closed:
+			return nil
+		case <-r.Context().Done():
+			return nil
+		}
+
+		if err := controller.SetWriteDeadline(time.Now().Add(keepalive.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		if _, err := w.Write(event); err != nil {
+			slog.InfoContext(r.Context(), "event stream write failed", "error", err, "connectionID", conn.id)
+			return nil
+		}
+		if err := controller.Flush(); err != nil {
+			slog.InfoContext(r.Context(), "event stream flush failed", "error", err, "connectionID", conn.id)
+			return nil
+		}
+	}
+}
+
+// encodeEvent leaves out the id of unsequenced messages so they don't move the client's
+// resume point
+func encodeEvent(seq uint64, data []byte) []byte {
+	var event bytes.Buffer
+	if seq > 0 {
+		fmt.Fprintf(&event, "id: %d\n", seq)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(bytes.TrimSuffix(line, []byte("\r")))
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+	return event.Bytes()
+}
@@ -0,0 +1,139 @@
+package websocketutil
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type event struct {
+	id   string
+	data string
+}
+
+func openEvents(t *testing.T, url, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set(LastEventIDHeader, lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body)
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) event {
+	t.Helper()
+	var e event
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data != nil {
+				e.data = strings.Join(data, "\n")
+				return e
+			}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestServerSentEventsResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{ServerSentEvents: true, ReplaySize: 10})
+	mux := http.NewServeMux()
+	hub.ServeOutbound(mux, "/feed")
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	events := openEvents(t, server.URL+"/feed", "")
+	awaitConnections(t, hub, 1)
+	hub.Push([]byte("first"), "/feed")
+	hub.Push([]byte("two\nlines"), "/feed")
+	assert.Equal(t, event{id: "1", data: "first"}, readEvent(t, events))
+	assert.Equal(t, event{id: "2", data: "two\nlines"}, readEvent(t, events))
+
+	hub.Push([]byte("missed"), "/feed")
+	resumed := openEvents(t, server.URL+"/feed", "2")
+	assert.Equal(t, event{id: "3", data: "missed"}, readEvent(t, resumed))
+
+	conn := dial(t, "ws"+strings.TrimPrefix(server.URL, "http")+"/feed")
+	awaitConnections(t, hub, 3)
+	hub.Push([]byte("everyone"), "/feed")
+	assert.Equal(t, "everyone", readString(t, conn))
+	assert.Equal(t, event{id: "4", data: "everyone"}, readEvent(t, resumed))
+}
+
+func TestServerSentEventsTyped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{ServerSentEvents: true})
+	mux := http.NewServeMux()
+	endpoint := ServeOutbound[*wrapperspb.StringValue](hub, mux, "/feed", ProtobufCodec{}, JSONCodec{})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	events := openEvents(t, server.URL+"/feed", "")
+	awaitConnections(t, hub, 1)
+	info := hub.Connections()[0]
+	if err := endpoint.SendTo(info.ID, wrapperspb.String("hi")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, event{data: `{"value":"hi"}`}, readEvent(t, events))
+}
+
+func TestCompression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(ctx, HubConfig{Compression: true})
+	mux := http.NewServeMux()
+	hub.ServeOutbound(mux, "/feed")
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/feed"
+
+	dialer := (&Dialer{Compression: true}).websocketDialer()
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+
+	plain, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	assert.Empty(t, resp.Header.Get("Sec-Websocket-Extensions"))
+
+	awaitConnections(t, hub, 2)
+	message := strings.Repeat("compressible ", 100)
+	hub.Push([]byte(message), "/feed")
+	assert.Equal(t, message, readString(t, conn))
+	assert.Equal(t, message, readString(t, plain))
+}
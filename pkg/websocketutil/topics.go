@@ -0,0 +1,349 @@
+package websocketutil
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// TopicsJSONSubprotocol frames topic connections as JSON text messages. It's the default
+	// when a client doesn't ask for a subprotocol.
+	TopicsJSONSubprotocol = "topics.json.v1"
+	// TopicsBinarySubprotocol frames topic connections as binary messages laid out as
+	// op (1 byte), id (4 bytes), topic length (2 bytes), topic, data, with big-endian integers
+	TopicsBinarySubprotocol = "topics.binary.v1"
+)
+
+type TopicOp byte
+
+const (
+	// OpSubscribe, OpUnsubscribe and OpPublish are sent by clients
+	OpSubscribe TopicOp = iota + 1
+	OpUnsubscribe
+	OpPublish
+	// OpMessage, OpAck and OpError are sent by the hub
+	OpMessage
+	OpAck
+	OpError
+)
+
+var topicOpNames = map[TopicOp]string{
+	OpSubscribe:   "subscribe",
+	OpUnsubscribe: "unsubscribe",
+	OpPublish:     "publish",
+	OpMessage:     "message",
+	OpAck:         "ack",
+	OpError:       "error",
+}
+
+func (o TopicOp) String() string {
+	if name, ok := topicOpNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("TopicOp(%d)", o)
+}
+
+func (o TopicOp) MarshalText() ([]byte, error) {
+	if _, ok := topicOpNames[o]; !ok {
+		return nil, fmt.Errorf("unknown topic op %d", o)
+	}
+	return []byte(o.String()), nil
+}
+
+func (o *TopicOp) UnmarshalText(text []byte) error {
+	for op, name := range topicOpNames {
+		if name == string(text) {
+			*o = op
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown topic op %q", text)
+}
+
+// TopicFrame is one message of the topic protocol. Clients subscribe, unsubscribe and
+// publish; a non-zero ID asks the hub to answer with an OpAck or OpError carrying the
+// same ID. For OpError, Data holds the error text.
+type TopicFrame struct {
+	Op    TopicOp
+	ID    uint32
+	Topic string
+	Data  []byte
+}
+
+// TopicMessage is a message a client published on a topic connection
+type TopicMessage struct {
+	ConnectionID uuid.UUID
+	Principal    string
+	Topic        string
+	Data         []byte
+}
+
+type jsonTopicFrame struct {
+	Type  TopicOp         `json:"type"`
+	ID    uint32          `json:"id,omitempty"`
+	Topic string          `json:"topic,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// MarshalJSON embeds Data as-is when it's valid JSON and as a string otherwise
+func (f TopicFrame) MarshalJSON() ([]byte, error) {
+	j := jsonTopicFrame{Type: f.Op, ID: f.ID, Topic: f.Topic}
+	switch {
+	case f.Op == OpError:
+		j.Error = string(f.Data)
+	case len(f.Data) == 0:
+	case json.Valid(f.Data):
+		j.Data = f.Data
+	default:
+		data, err := json.Marshal(string(f.Data))
+		if err != nil {
+			return nil, err
+		}
+		j.Data = data
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON keeps the raw JSON of the data field, so string payloads stay quoted
+func (f *TopicFrame) UnmarshalJSON(data []byte) error {
+	var j jsonTopicFrame
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*f = TopicFrame{Op: j.Type, ID: j.ID, Topic: j.Topic, Data: j.Data}
+	if j.Type == OpError {
+		f.Data = []byte(j.Error)
+	}
+	return nil
+}
+
+func (f TopicFrame) MarshalBinary() ([]byte, error) {
+	if len(f.Topic) > math.MaxUint16 {
+		return nil, fmt.Errorf("topic is %d bytes, the limit is %d", len(f.Topic), math.MaxUint16)
+	}
+	data := make([]byte, 7+len(f.Topic)+len(f.Data))
+	data[0] = byte(f.Op)
+	binary.BigEndian.PutUint32(data[1:], f.ID)
+	binary.BigEndian.PutUint16(data[5:], uint16(len(f.Topic)))
+	copy(data[7:], f.Topic)
+	copy(data[7+len(f.Topic):], f.Data)
+	return data, nil
+}
+
+func (f *TopicFrame) UnmarshalBinary(data []byte) error {
+	if len(data) < 7 {
+		return fmt.Errorf("topic frame too short: %d bytes", len(data))
+	}
+	topicLen := int(binary.BigEndian.Uint16(data[5:]))
+	if len(data) < 7+topicLen {
+		return fmt.Errorf("topic frame too short for a %d byte topic", topicLen)
+	}
+	*f = TopicFrame{
+		Op:    TopicOp(data[0]),
+		ID:    binary.BigEndian.Uint32(data[1:]),
+		Topic: string(data[7 : 7+topicLen]),
+		Data:  data[7+topicLen:],
+	}
+	return nil
+}
+
+// ServeTopics accepts connections that subscribe to topics with the topic protocol instead
+// of receiving everything pushed to their path. Messages clients publish are returned on
+// the channel; use PushTopic to deliver them, or anything else, to subscribers.
+func (h *Hub) ServeTopics(mux *http.ServeMux, path string) <-chan TopicMessage {
+	output := make(chan TopicMessage, 100)
+	keepalive := h.config.Keepalive
+	upgrader := h.upgrader
+	upgrader.Subprotocols = []string{TopicsJSONSubprotocol, TopicsBinarySubprotocol}
+
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		connectionID := uuid.New()
+		args := []any{"connectionID", connectionID}
+		defer func() {
+			p := recover()
+			if p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), err.Error(), args...)
+			}
+		}()
+		slog.InfoContext(r.Context(), "recieved topic connection", args...)
+
+		principal, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			http.Error(w, "Could not upgrade to websocket", http.StatusInternalServerError)
+			return
+		}
+		defer ws.Close()
+		keepalive.configure(ws)
+		h.configureCompression(ws)
+
+		conn := h.newConnection(connectionID, r, principal)
+		conn.writable = true
+		conn.framing = jsonTopicFraming
+		conn.topics = make(map[string]struct{})
+		if ws.Subprotocol() == TopicsBinarySubprotocol {
+			conn.framing = binaryTopicFraming
+		}
+		defer func() {
+			conn.close(websocket.CloseNormalClosure, "goodbye")
+			keepalive.close(ws, conn.closeCode, conn.closeText)
+		}()
+		if !h.register(conn, 0, false) {
+			return
+		}
+		defer h.unregister(conn)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				messageType, message, err := keepalive.read(ws)
+				if err != nil {
+					if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+						slog.InfoContext(r.Context(), "websocket read failed", "error", err, "connectionID", connectionID)
+					}
+					conn.close(closeReason(err))
+					return
+				}
+				var f TopicFrame
+				if messageType == websocket.BinaryMessage {
+					err = f.UnmarshalBinary(message)
+				} else {
+					err = json.Unmarshal(message, &f)
+				}
+				if err == nil {
+					err = h.handleTopicFrame(r.Context(), conn, f, output)
+				}
+				if err != nil {
+					conn.reply(TopicFrame{Op: OpError, ID: f.ID, Topic: f.Topic, Data: []byte(err.Error())})
+				} else if f.ID != 0 {
+					conn.reply(TopicFrame{Op: OpAck, ID: f.ID, Topic: f.Topic})
+				}
+			}
+		}()
+		go keepalive.ping(ws, conn.closed)
+
+		h.write(r.Context(), ws, conn, done)
+	})
+	return output
+}
+
+func (h *Hub) handleTopicFrame(ctx context.Context, conn *connection, f TopicFrame, output chan<- TopicMessage) error {
+	if len(f.Topic) == 0 {
+		return fmt.Errorf("%v requires a topic", f.Op)
+	}
+	switch f.Op {
+	case OpSubscribe:
+		return h.subscribe(conn, f.Topic)
+	case OpUnsubscribe:
+		h.unsubscribe(conn, f.Topic)
+		return nil
+	case OpPublish:
+		select {
+		case output <- TopicMessage{ConnectionID: conn.id, Principal: conn.principal, Topic: f.Topic, Data: f.Data}:
+			return nil
+		case <-conn.closed:
+			return fmt.Errorf("connection closed")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+		return fmt.Errorf("unsupported op %v", f.Op)
+	}
+}
+
+// reply queues an already encoded answer. Replies wait for room instead of following the
+// slow consumer policy, which slows down a client that floods the hub with requests.
+func (c *connection) reply(f TopicFrame) {
+	var data []byte
+	var err error
+	if c.framing == binaryTopicFraming {
+		data, err = f.MarshalBinary()
+	} else {
+		data, err = json.Marshal(f)
+	}
+	if err != nil {
+		slog.Error("failed to encode topic reply", "error", err, "connectionID", c.id)
+		return
+	}
+	select {
+	case c.queue <- frame{topic: f.Topic, data: data, control: true}:
+	case <-c.closed:
+	}
+}
+
+func (h *Hub) subscribe(conn *connection, topic string) error {
+	h.rwMux.Lock()
+	defer h.rwMux.Unlock()
+	if h.topics == nil {
+		return fmt.Errorf("hub stopped")
+	}
+	if _, ok := h.topics[topic]; !ok {
+		h.topics[topic] = make(map[uuid.UUID]*connection)
+	}
+	h.topics[topic][conn.id] = conn
+	conn.topics[topic] = struct{}{}
+	return nil
+}
+
+func (h *Hub) unsubscribe(conn *connection, topic string) {
+	h.rwMux.Lock()
+	defer h.rwMux.Unlock()
+	if h.topics == nil {
+		return
+	}
+	h.removeSubscriber(conn, topic)
+}
+
+// removeSubscriber must be called with rwMux held
+func (h *Hub) removeSubscriber(conn *connection, topic string) {
+	delete(conn.topics, topic)
+	delete(h.topics[topic], conn.id)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+}
+
+// PushTopic queues message for every connection subscribed to topic, applying the hub's
+// SlowConsumerPolicy like Push
+func (h *Hub) PushTopic(message []byte, topic string) {
+	h.relay(envelope{Topic: topic, Data: message}, true)
+	_, dropped := h.pushTopic(frame{data: message}, topic, true)
+	if dropped > 0 {
+		slog.Debug("dropped messages for slow consumers", "topic", topic, "dropped", dropped)
+	}
+}
+
+// TryPushTopic is PushTopic without ever waiting, see TryPush
+func (h *Hub) TryPushTopic(message []byte, topic string) (delivered, dropped int) {
+	h.relay(envelope{Topic: topic, Data: message}, false)
+	return h.pushTopic(frame{data: message}, topic, false)
+}
+
+func (h *Hub) pushTopic(f frame, topic string, wait bool) (delivered, dropped int) {
+	h.rwMux.RLock()
+	if h.topics == nil {
+		h.rwMux.RUnlock()
+		return 0, 0
+	}
+	conns := snapshot(h.topics[topic])
+	h.rwMux.RUnlock()
+	f.topic = topic
+	return h.deliver(conns, f, wait)
+}
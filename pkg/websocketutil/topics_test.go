@@ -0,0 +1,141 @@
+package websocketutil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func startTopics(t *testing.T, ctx context.Context) (*Hub, <-chan TopicMessage, string) {
+	t.Helper()
+	hub := NewHub(ctx, HubConfig{})
+	mux := http.NewServeMux()
+	published := hub.ServeTopics(mux, "/topics")
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return hub, published, "ws" + strings.TrimPrefix(server.URL, "http") + "/topics"
+}
+
+func dialTopics(t *testing.T, url, subprotocol string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	assert.Equal(t, subprotocol, conn.Subprotocol())
+	return conn
+}
+
+func sendFrame(t *testing.T, conn *websocket.Conn, f TopicFrame) {
+	t.Helper()
+	var err error
+	if conn.Subprotocol() == TopicsBinarySubprotocol {
+		var data []byte
+		data, err = f.MarshalBinary()
+		if err == nil {
+			err = conn.WriteMessage(websocket.BinaryMessage, data)
+		}
+	} else {
+		err = conn.WriteJSON(f)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) TopicFrame {
+	t.Helper()
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f TopicFrame
+	if messageType == websocket.BinaryMessage {
+		err = f.UnmarshalBinary(data)
+	} else {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestTopicsJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, _, url := startTopics(t, ctx)
+	conn := dialTopics(t, url, TopicsJSONSubprotocol)
+
+	sendFrame(t, conn, TopicFrame{Op: OpSubscribe, ID: 1, Topic: "room-a"})
+	assert.Equal(t, TopicFrame{Op: OpAck, ID: 1, Topic: "room-a"}, readFrame(t, conn))
+
+	delivered, _ := hub.TryPushTopic([]byte(`{"text":"hi"}`), "room-a")
+	assert.Equal(t, 1, delivered)
+	delivered, _ = hub.TryPushTopic([]byte(`{"text":"hi"}`), "room-b")
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, TopicFrame{Op: OpMessage, Topic: "room-a", Data: []byte(`{"text":"hi"}`)}, readFrame(t, conn))
+
+	sendFrame(t, conn, TopicFrame{Op: OpUnsubscribe, ID: 2, Topic: "room-a"})
+	assert.Equal(t, OpAck, readFrame(t, conn).Op)
+	delivered, _ = hub.TryPushTopic([]byte("{}"), "room-a")
+	assert.Equal(t, 0, delivered)
+
+	sendFrame(t, conn, TopicFrame{Op: OpSubscribe, ID: 3})
+	reply := readFrame(t, conn)
+	assert.Equal(t, OpError, reply.Op)
+	assert.Equal(t, uint32(3), reply.ID)
+	assert.Equal(t, "subscribe requires a topic", string(reply.Data))
+}
+
+func TestTopicsBinary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, published, url := startTopics(t, ctx)
+	conn := dialTopics(t, url, TopicsBinarySubprotocol)
+
+	sendFrame(t, conn, TopicFrame{Op: OpSubscribe, ID: 1, Topic: "a"})
+	assert.Equal(t, OpAck, readFrame(t, conn).Op)
+	sendFrame(t, conn, TopicFrame{Op: OpSubscribe, ID: 2, Topic: "b"})
+	assert.Equal(t, OpAck, readFrame(t, conn).Op)
+
+	hub.PushTopic([]byte{0, 1, 2}, "b")
+	hub.PushTopic([]byte{3}, "a")
+	assert.Equal(t, TopicFrame{Op: OpMessage, Topic: "b", Data: []byte{0, 1, 2}}, readFrame(t, conn))
+	assert.Equal(t, TopicFrame{Op: OpMessage, Topic: "a", Data: []byte{3}}, readFrame(t, conn))
+
+	sendFrame(t, conn, TopicFrame{Op: OpPublish, ID: 3, Topic: "a", Data: []byte("hello")})
+	message := <-published
+	assert.Equal(t, "a", message.Topic)
+	assert.Equal(t, "hello", string(message.Data))
+	assert.Equal(t, TopicFrame{Op: OpAck, ID: 3, Topic: "a", Data: []byte{}}, readFrame(t, conn))
+
+	sendFrame(t, conn, TopicFrame{Op: OpMessage, ID: 4, Topic: "a"})
+	assert.Equal(t, OpError, readFrame(t, conn).Op)
+
+	cancel()
+	<-hub.Done()
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestTopicFrameJSON(t *testing.T) {
+	data, err := json.Marshal(TopicFrame{Op: OpMessage, Topic: "t", Data: []byte("plain text")})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type":"message","topic":"t","data":"plain text"}`, string(data))
+
+	data, err = json.Marshal(TopicFrame{Op: OpError, ID: 7, Data: []byte("bad")})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type":"error","id":7,"error":"bad"}`, string(data))
+
+	var f TopicFrame
+	assert.Error(t, json.Unmarshal([]byte(`{"type":"shout"}`), &f))
+}